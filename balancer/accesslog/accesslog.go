@@ -0,0 +1,137 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/core"
+	"github.com/sirupsen/logrus"
+)
+
+// Close reasons of the entries
+const (
+	CloseClient        = "client_closed"
+	CloseRouterHost    = "router_host_closed"
+	CloseCompleted     = "completed"
+	CloseIdle          = "idle_timeout"
+	CloseDenied        = "denied"
+	CloseLimit         = "connection_limit"
+	CloseNoRouterHost  = "no_router_host"
+	CloseDialError     = "dial_error"
+	CloseProxyProtocol = "proxy_protocol_error"
+	CloseTLSError      = "tls_error"
+	CloseProxyError    = "proxy_error"
+)
+
+// Stdout as path writes the access log to stdout
+const Stdout = "-"
+
+type Config struct {
+	// Path of the access log file, Stdout or empty to disable the access log
+	Path string
+
+	// The file is rotated when it reaches MaxSize bytes or is older than RotateInterval. 0 disables the check.
+	// Only the newest MaxBackups rotated files are kept, 0 keeps all of them
+	MaxSize        int64
+	RotateInterval time.Duration
+	MaxBackups     int
+}
+
+// Entry is one line of the access log for a connection, an http request with request
+// balancing or a udp session. Time is when the client connection was accepted
+type Entry struct {
+	Time        time.Time `json:"time"`
+	Client      string    `json:"client"`
+	Listener    string    `json:"listener"`
+	Hostname    string    `json:"hostname,omitempty"`
+	Route       string    `json:"route,omitempty"`
+	Cluster     string    `json:"cluster,omitempty"`
+	RouterHost  string    `json:"routerHost,omitempty"`
+	DialTime    float64   `json:"dialTimeMs"`
+	Duration    float64   `json:"durationMs"`
+	BytesIn     uint64    `json:"bytesIn"`
+	BytesOut    uint64    `json:"bytesOut"`
+	CloseReason string    `json:"closeReason"`
+	Retries     int       `json:"retries"`
+}
+
+// SetElection fills the route, cluster and router host of the entry
+func (e *Entry) SetElection(election *core.Election) {
+	if election.Route != nil {
+		e.Route = election.Route.URL
+	}
+	if election.Cluster != nil {
+		e.Cluster = election.Cluster.Key
+	}
+	e.RouterHost = election.RouterHost.Name
+	e.Retries = election.Retries
+}
+
+// SetDialTime sets the time from started until the connection to the router host was ready
+func (e *Entry) SetDialTime(started time.Time) {
+	e.DialTime = milliseconds(time.Since(started))
+}
+
+// Logger writes the entries as JSON lines. A nil Logger discards them
+type Logger struct {
+	out io.Writer
+	mux sync.Mutex
+}
+
+func New(cfg Config) (*Logger, error) {
+	if len(cfg.Path) == 0 {
+		return nil, nil
+	}
+	if cfg.Path == Stdout {
+		return &Logger{out: os.Stdout}, nil
+	}
+
+	f, err := openRotatingFile(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Logger{out: f}, nil
+}
+
+// Log writes the entry with the duration since the connection was accepted
+func (l *Logger) Log(e *Entry) {
+	if l == nil {
+		return
+	}
+
+	if !e.Time.IsZero() {
+		e.Duration = milliseconds(time.Since(e.Time))
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		logrus.Error("Failed to encode access log entry: ", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if _, err := l.out.Write(line); err != nil {
+		logrus.Error("Failed to write access log: ", err)
+	}
+}
+
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if c, ok := l.out.(io.Closer); ok && l.out != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,115 @@
+package accesslog
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// backupTimeFormat sorts the rotated files by their age
+const backupTimeFormat = "20060102T150405.000"
+
+// rotatingFile writes to path and moves the file to path.<time> when it gets too big or too old
+type rotatingFile struct {
+	cfg Config
+
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotatingFile(cfg Config) (*rotatingFile, error) {
+	f := &rotatingFile{cfg: cfg}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.cfg.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(b []byte) (int, error) {
+	if f.needsRotation(len(b)) {
+		if err := f.rotate(); err != nil {
+			logrus.Error("Failed to rotate access log: ", err)
+		}
+	}
+
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) needsRotation(next int) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.cfg.MaxSize > 0 && f.size+int64(next) > f.cfg.MaxSize {
+		return true
+	}
+	return f.cfg.RotateInterval > 0 && time.Since(f.opened) >= f.cfg.RotateInterval
+}
+
+// rotate renames the open file before the new one is opened. If the rotation fails,
+// the entries are still written to the old file
+func (f *rotatingFile) rotate() error {
+	backup := f.cfg.Path + "." + time.Now().Format(backupTimeFormat)
+	if err := os.Rename(f.cfg.Path, backup); err != nil {
+		return err
+	}
+
+	old := f.file
+	if err := f.open(); err != nil {
+		if err := os.Rename(backup, f.cfg.Path); err != nil {
+			logrus.Error("Failed to restore access log after failed rotation: ", err)
+		}
+		return err
+	}
+	if err := old.Close(); err != nil {
+		logrus.Warn("Failed to close rotated access log: ", err)
+	}
+
+	f.removeOldBackups()
+	return nil
+}
+
+// removeOldBackups keeps the newest MaxBackups rotated files
+func (f *rotatingFile) removeOldBackups() {
+	if f.cfg.MaxBackups <= 0 {
+		return
+	}
+
+	backups, err := filepath.Glob(f.cfg.Path + ".*")
+	if err != nil || len(backups) <= f.cfg.MaxBackups {
+		return
+	}
+
+	sort.Strings(backups)
+	for _, old := range backups[:len(backups)-f.cfg.MaxBackups] {
+		if err := os.Remove(old); err != nil {
+			logrus.Warn("Failed to remove old access log: ", err)
+		}
+	}
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
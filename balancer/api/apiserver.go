@@ -1,14 +1,18 @@
 package api
 
 import (
+	"crypto/subtle"
+	"fmt"
 	"net/http"
-
-	"sync"
+	"time"
 
 	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer"
 	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/core"
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/metrics"
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/stats"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 )
 
@@ -24,10 +28,15 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-var mux sync.Mutex
-var uiConnection *websocket.Conn
+// certificateUpdate is a PEM encoded certificate chain and its key
+type certificateUpdate struct {
+	Certificate string `json:"certificate"`
+	Key         string `json:"key"`
+}
 
-func RunAPI(bind string, b *balancer.Balancer) {
+// RunAPI serves the api and the UI on bind. The certificate endpoints require token as
+// bearer token and are not served if it is empty
+func RunAPI(bind string, token string, b *balancer.Balancer) {
 	logrus.Infof("Starting api server on " + bind)
 
 	router := gin.New()
@@ -36,14 +45,20 @@ func RunAPI(bind string, b *balancer.Balancer) {
 	router.GET("/", func(c *gin.Context) {
 		c.Redirect(http.StatusTemporaryRedirect, "/s/")
 	})
+	ui := newHub(b.Scheduler.StatsHandler)
+	go ui.run()
 	router.GET("/ws", func(c *gin.Context) {
-		onUISocket(c.Writer, c.Request, b)
+		ui.serveUI(c.Writer, c.Request)
 	})
 	router.POST("/ui/resetstats", func(c *gin.Context) {
 		b.Scheduler.ResetStats <- true
 		c.Status(http.StatusOK)
 	})
 	router.StaticFS("/s/", http.Dir("static"))
+
+	metrics.Register(b.Scheduler.RoutingTable)
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
 	router.POST("/api/cluster/:clusterkey", func(c *gin.Context) {
 		clusterKey := c.Param("clusterkey")
 
@@ -57,38 +72,133 @@ func RunAPI(bind string, b *balancer.Balancer) {
 		}
 	})
 
-	go sendStatisticsToUI(b)
+	router.DELETE("/api/cluster/:clusterkey", func(c *gin.Context) {
+		if b.Scheduler.RemoveCluster(c.Param("clusterkey")) {
+			c.Status(http.StatusOK)
+		} else {
+			c.Status(http.StatusNotFound)
+		}
+	})
 
-	router.Run(bind)
-}
+	router.GET("/api/routes", func(c *gin.Context) {
+		c.JSON(http.StatusOK, b.Scheduler.RoutingTable().RouteStats())
+	})
+	router.GET("/api/routes/:hostname", func(c *gin.Context) {
+		stats, ok := b.Scheduler.RoutingTable().RouteStats()[core.NormalizeHostname(c.Param("hostname"))]
+		if !ok {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.JSON(http.StatusOK, stats)
+	})
+
+	router.GET("/api/stats", func(c *gin.Context) {
+		series, ok := b.Scheduler.StatsHandler.Stats(c.DefaultQuery("resolution", stats.ResolutionLive))
+		if !ok {
+			c.String(http.StatusBadRequest, "unknown resolution")
+			return
+		}
+		c.JSON(http.StatusOK, series)
+	})
+	router.GET("/api/stats/history", func(c *gin.Context) {
+		query, err := historyQuery(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		samples, err := b.Scheduler.StatsHandler.History(query)
+		if err == stats.ErrHistoryDisabled {
+			c.String(http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			logrus.Error("Failed to read stats history: ", err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.JSON(http.StatusOK, samples)
+	})
 
-func onUISocket(w http.ResponseWriter, r *http.Request, b *balancer.Balancer) {
-	logrus.Debugf("UI joined")
+	router.GET("/api/events", func(c *gin.Context) {
+		streamEvents(c, b.Scheduler.Events)
+	})
 
-	c, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		logrus.Warnf("failed to set websocket upgrade: %+v", err)
-		return
+	// Certificates contain private keys, so they are only managed with the token
+	if len(token) > 0 {
+		certificates := router.Group("/api/certificates", requireToken(token))
+		certificates.GET("", func(c *gin.Context) {
+			c.JSON(http.StatusOK, b.Certificates.List())
+		})
+		certificates.POST("", func(c *gin.Context) {
+			var data certificateUpdate
+			if err := c.BindJSON(&data); err != nil {
+				logrus.Warnf("Invalid API call to /api/certificates. Err: %v", err.Error())
+				c.Status(http.StatusBadRequest)
+				return
+			}
+
+			hostnames, err := b.Certificates.Add([]byte(data.Certificate), []byte(data.Key))
+			if err != nil {
+				logrus.Warnf("Invalid certificate in API call to /api/certificates. Err: %v", err.Error())
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+			c.JSON(http.StatusCreated, hostnames)
+		})
+		certificates.DELETE("/:hostname", func(c *gin.Context) {
+			if b.Certificates.Remove(c.Param("hostname")) {
+				c.Status(http.StatusOK)
+			} else {
+				c.Status(http.StatusNotFound)
+			}
+		})
+	} else {
+		logrus.Info("No api token is set, the certificate endpoints are disabled")
 	}
 
-	mux.Lock()
-	uiConnection = c
-	mux.Unlock()
+	router.Run(bind)
 }
 
-func sendStatisticsToUI(b *balancer.Balancer) {
-	for {
-		select {
-		case stats := <-b.Scheduler.StatsHandler.StatsTick:
-			mux.Lock()
-			if uiConnection != nil {
-				err := uiConnection.WriteJSON(stats)
-				if err != nil {
-					logrus.Error("connection to UI was closed, will not send updates now", err)
-					uiConnection = nil
-				}
-			}
-			mux.Unlock()
+// requireToken rejects the requests that don't have the token as bearer token
+func requireToken(token string) gin.HandlerFunc {
+	want := []byte("Bearer " + token)
+	return func(c *gin.Context) {
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), want) != 1 {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
 		}
+		c.Next()
+	}
+}
+
+// historyQuery reads the RFC3339 times from and to, the host and the step of the request.
+// The default is the last hour
+func historyQuery(c *gin.Context) (stats.HistoryQuery, error) {
+	q := stats.HistoryQuery{
+		To:   time.Now(),
+		Host: c.Query("host"),
+	}
+
+	var err error
+	if step := c.Query("step"); len(step) > 0 {
+		if q.Step, err = time.ParseDuration(step); err != nil {
+			return q, fmt.Errorf("invalid step: %v", err)
+		}
+	}
+	if to := c.Query("to"); len(to) > 0 {
+		if q.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return q, fmt.Errorf("invalid to: %v", err)
+		}
+	}
+	q.From = q.To.Add(-time.Hour)
+	if from := c.Query("from"); len(from) > 0 {
+		if q.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return q, fmt.Errorf("invalid from: %v", err)
+		}
+	}
+	if q.From.After(q.To) {
+		return q, fmt.Errorf("from is after to")
 	}
+	return q, nil
 }
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/events"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// keepAlivePeriod is the time between the comments that keep idle event streams open
+const keepAlivePeriod = 15 * time.Second
+
+// streamEvents sends the events of the bus as Server-Sent Events until the client disconnects.
+// The types parameter is a comma separated list of the event types to send, all if it is empty
+func streamEvents(c *gin.Context, bus *events.Bus) {
+	var types []string
+	if t := c.Query("types"); len(t) > 0 {
+		types = strings.Split(t, ",")
+		for _, t := range types {
+			if !events.ValidType(t) {
+				c.String(http.StatusBadRequest, "unknown event type %v", t)
+				return
+			}
+		}
+	}
+
+	sub := bus.Subscribe(types)
+	defer bus.Unsubscribe(sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(keepAlivePeriod)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				logrus.Debugf("Closing event stream of slow client %v", c.ClientIP())
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				logrus.Error("Failed to encode event: ", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(c.Writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+
+		case <-c.Request.Context().Done():
+			return
+		}
+		c.Writer.Flush()
+	}
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/core"
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/stats"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// writeWait is the time to write a message to a UI client
+	writeWait = 10 * time.Second
+
+	// A UI client that does not answer a ping within pongWait is disconnected
+	pongWait   = 60 * time.Second
+	pingPeriod = pongWait * 9 / 10
+
+	// sendQueueSize are the messages queued per UI client. A client that falls
+	// further behind is disconnected
+	sendQueueSize = 16
+)
+
+// uiClient is a websocket connection of a UI with its queue of encoded messages
+type uiClient struct {
+	conn *websocket.Conn
+	send chan []byte
+}
+
+// hub sends the stats of every tick to all connected UIs
+type hub struct {
+	statsHandler *stats.StatsHandler
+	clients      map[*uiClient]bool
+
+	register   chan *uiClient
+	unregister chan *uiClient
+}
+
+func newHub(statsHandler *stats.StatsHandler) *hub {
+	return &hub{
+		statsHandler: statsHandler,
+		clients:      make(map[*uiClient]bool),
+		register:     make(chan *uiClient),
+		unregister:   make(chan *uiClient),
+	}
+}
+
+func (h *hub) run() {
+	for {
+		select {
+		case c := <-h.register:
+			logrus.Debugf("UI %v joined", c.conn.RemoteAddr())
+			h.clients[c] = true
+
+			// Send the full state so the UI does not wait for the next tick
+			if current, ok := h.statsHandler.Stats(stats.ResolutionLive); ok {
+				h.send(c, encodeStats(current))
+			}
+
+		case c := <-h.unregister:
+			h.remove(c)
+
+		case s := <-h.statsHandler.StatsTick:
+			msg := encodeStats(s)
+			for c := range h.clients {
+				h.send(c, msg)
+			}
+		}
+	}
+}
+
+// send queues the message for the client or disconnects it if its queue is full
+func (h *hub) send(c *uiClient, msg []byte) {
+	if msg == nil {
+		return
+	}
+
+	select {
+	case c.send <- msg:
+	default:
+		logrus.Warnf("UI %v is too slow, disconnecting it", c.conn.RemoteAddr())
+		h.remove(c)
+	}
+}
+
+func (h *hub) remove(c *uiClient) {
+	if _, ok := h.clients[c]; ok {
+		logrus.Debugf("UI %v left", c.conn.RemoteAddr())
+		delete(h.clients, c)
+		close(c.send)
+	}
+}
+
+func encodeStats(s core.GlobalStats) []byte {
+	msg, err := json.Marshal(s)
+	if err != nil {
+		logrus.Error("Failed to encode stats for the UI: ", err)
+		return nil
+	}
+	return msg
+}
+
+// serveUI upgrades the request to a websocket and registers it at the hub
+func (h *hub) serveUI(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logrus.Warnf("failed to set websocket upgrade: %+v", err)
+		return
+	}
+
+	c := &uiClient{
+		conn: conn,
+		send: make(chan []byte, sendQueueSize),
+	}
+	h.register <- c
+
+	go c.writePump()
+	go c.readPump(h)
+}
+
+// readPump handles the pongs and the close of the UI. The UI sends nothing else
+func (c *uiClient) readPump(h *hub) {
+	defer func() {
+		h.unregister <- c
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(512)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		if _, _, err := c.conn.ReadMessage(); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				logrus.Debugf("UI %v closed: %v", c.conn.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+// writePump writes the queued messages and pings the UI until the hub closes the queue
+func (c *uiClient) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				logrus.Debugf("Failed to send stats to UI %v: %v", c.conn.RemoteAddr(), err)
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -2,8 +2,7 @@ package balancing
 
 import (
 	"errors"
-
-	"strings"
+	"fmt"
 
 	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/core"
 	"github.com/sirupsen/logrus"
@@ -12,50 +11,100 @@ import (
 type RouterHostGroup struct {
 	Weight      int
 	RouterHosts []*core.RouterHost
+	Route       *core.Route
+	RouteState  *core.RouteState
+
+	// ALPN is the application protocol all router hosts of the group support
+	ALPN string
 }
 
-func ElectRouterHost(ctx core.Context, clusters map[string]*core.Cluster) (*core.RouterHost, error) {
+// ElectRouterHost elects a router host for the connection and reserves a connection slot on it.
+// The clusters are chosen by weight, strategy selects the router host within them.
+// The caller has to release the returned election once the connection is closed.
+func ElectRouterHost(ctx core.Context, clusters map[string]*core.Cluster, strategy Strategy) (*core.Election, error) {
 	if len(clusters) == 0 {
 		return nil, errors.New("can't elect router host, no OpenShift cluster defined")
 	}
 
-	var possibleRouterHosts []*core.RouterHost
+	if len(ctx.Cluster) > 0 {
+		cl, ok := clusters[ctx.Cluster]
+		if !ok {
+			return nil, fmt.Errorf("can't elect router host, cluster %v is not defined", ctx.Cluster)
+		}
+		clusters = map[string]*core.Cluster{cl.Key: cl}
+	}
+
+	if len(ctx.Service) > 0 {
+		return electServiceBackend(ctx.Service, clusters, strategy)
+	}
+
+	limitErr := &LimitError{}
 
 	if len(ctx.Hostname) > 0 {
 		var hostGroups []*RouterHostGroup
+		routeFound, routeAllowed, alpnRequired := false, false, false
+		deniedErr := &DeniedError{Hostname: ctx.Hostname}
 
 		// Check if cluster does handle that route
 		for _, cl := range clusters {
-			for _, r := range cl.Routes {
-				if strings.ToLower(strings.TrimSpace(r.URL)) == strings.ToLower(strings.TrimSpace(ctx.Hostname)) {
-					grp := &RouterHostGroup{
-						RouterHosts: []*core.RouterHost{},
-						Weight:      r.Weight,
-					}
-
-					// Add every healthy router of that cluster
-					for _, rh := range cl.RouterHosts {
-						if !rh.LastState.Healthy {
-							continue
-						}
-						grp.RouterHosts = append(grp.RouterHosts, rh)
-					}
-
-					hostGroups = append(hostGroups, grp)
-
-					// Routes are unique
-					break
-				}
+			r, state, ok := cl.Route(ctx.Hostname)
+			if !ok {
+				continue
+			}
+			routeFound = true
+
+			// A denied client takes no slot and never falls back to the router hosts of other routes
+			if !r.SourceAllowed(ctx.Client) {
+				deniedErr.RouteStates = append(deniedErr.RouteStates, state)
+				continue
+			}
+			routeAllowed = true
+
+			if state.AtLimit(r.MaxConnections) {
+				logrus.Debugf("Route '%v' on cluster %v is at its connection limit", ctx.Hostname, cl.Key)
+				limitErr.RouteStates = append(limitErr.RouteStates, state)
+				continue
+			}
+
+			// Add every healthy router of that cluster that can take another connection
+			grp := &RouterHostGroup{
+				RouterHosts: availableRouterHosts(cl.RouterHosts, limitErr),
+				Weight:      r.Weight,
+				Route:       r,
+				RouteState:  state,
+			}
+
+			// TLS passthrough connections can go to router hosts that support the protocol of the client
+			if ctx.HTTPS && !ctx.Terminated && len(r.ALPN) > 0 {
+				grp.ALPN = r.ALPNProtocol(ctx.ALPN)
+				grp.RouterHosts, grp.ALPN = alpnRouterHosts(grp.RouterHosts, grp.ALPN, r.ALPNMode)
+				alpnRequired = alpnRequired || r.ALPNMode == core.ALPNRequire
+			}
+
+			// A cluster without available router hosts gets no share of the weight
+			if len(grp.RouterHosts) > 0 {
+				hostGroups = append(hostGroups, grp)
+			} else {
+				logrus.Debugf("Cluster %v serves route '%v' but has no available router hosts", cl.Key, ctx.Hostname)
 			}
 		}
 
-		// Check if route was found on any cluster
+		// Check if route was found on any cluster with available router hosts
 		if len(hostGroups) > 0 {
-			var err error
-			possibleRouterHosts, err = getPossibleRouterHostsBasedOnWeight(hostGroups)
+			// Routes drained to weight 0 on every cluster are not balanced to all router hosts
+			grp, err := getRouterHostGroupBasedOnWeight(hostGroups)
 			if err != nil {
-				logrus.Error(err.Error())
+				return nil, fmt.Errorf("can't elect router host for route '%v': %v", ctx.Hostname, err)
 			}
+			return acquireRouterHost(grp, clusters, strategy, limitErr)
+		} else if routeFound && !routeAllowed {
+			return nil, deniedErr
+		} else if limitErr.limited() {
+			return nil, limitErr
+		} else if alpnRequired {
+			return nil, fmt.Errorf("no router host supports the application protocols %v of the client for route '%v'", ctx.ALPN, ctx.Hostname)
+		} else if routeFound {
+			logrus.Warnf("Route '%v' has no healthy router hosts on any cluster. Balancing to all healthy router hosts", ctx.Hostname)
 		} else {
 			logrus.Warnf("Route '%v' has no valid target router hosts on any cluster. Balancing to all healthy router hosts", ctx.Hostname)
 		}
@@ -63,17 +112,102 @@ func ElectRouterHost(ctx core.Context, clusters map[string]*core.Cluster) (*core
 		logrus.Warnf("No route name was parsed. Balancing to all healthy router hosts")
 	}
 
-	if len(possibleRouterHosts) == 0 {
-		for _, cl := range clusters {
-			for _, rh := range cl.RouterHosts {
-				if !rh.LastState.Healthy {
-					continue
-				}
-				possibleRouterHosts = append(possibleRouterHosts, rh)
+	// Only the limits of the fallback router hosts matter from here
+	limitErr = &LimitError{}
+
+	grp := &RouterHostGroup{}
+	for _, cl := range clusters {
+		grp.RouterHosts = append(grp.RouterHosts, availableRouterHosts(cl.RouterHosts, limitErr)...)
+	}
+
+	if len(grp.RouterHosts) == 0 && limitErr.limited() {
+		return nil, limitErr
+	}
+
+	return acquireRouterHost(grp, clusters, strategy, limitErr)
+}
+
+// availableRouterHosts returns the healthy router hosts that are below their connection limit
+func availableRouterHosts(hosts map[string]*core.RouterHost, limitErr *LimitError) []*core.RouterHost {
+	var routerHosts []*core.RouterHost
+	for _, rh := range hosts {
+		if !rh.Healthy() {
+			continue
+		}
+		if rh.AtLimit() {
+			limitErr.RouterHosts = append(limitErr.RouterHosts, rh)
+			continue
+		}
+		routerHosts = append(routerHosts, rh)
+	}
+	return routerHosts
+}
+
+// alpnRouterHosts returns the router hosts that support proto together with the protocol they were
+// selected for. If none of them does, all router hosts are returned for ALPNPrefer and none for ALPNRequire
+func alpnRouterHosts(routerHosts []*core.RouterHost, proto string, mode string) ([]*core.RouterHost, string) {
+	var supporting []*core.RouterHost
+	if len(proto) > 0 {
+		for _, rh := range routerHosts {
+			if rh.SupportsALPN(proto) {
+				supporting = append(supporting, rh)
 			}
 		}
 	}
 
-	// From all possible router hosts get the one with the least connections
-	return getRouterHostWithLeastConn(possibleRouterHosts)
+	if len(supporting) > 0 {
+		return supporting, proto
+	}
+	if mode == core.ALPNRequire {
+		return nil, ""
+	}
+	return routerHosts, ""
+}
+
+// acquireRouterHost reserves a connection slot on the route and the
+// router host of the group that is selected by strategy
+func acquireRouterHost(grp *RouterHostGroup, clusters map[string]*core.Cluster, strategy Strategy, limitErr *LimitError) (*core.Election, error) {
+	if grp.RouteState != nil && !grp.RouteState.TryAcquire(grp.Route.MaxConnections) {
+		// Another connection took the last slot since the limit was checked
+		limitErr.RouteStates = append(limitErr.RouteStates, grp.RouteState)
+		return nil, limitErr
+	}
+
+	routerHosts := grp.RouterHosts
+	for {
+		// From all possible router hosts get the best one of the strategy
+		rh, err := strategy(routerHosts)
+		if err != nil {
+			if grp.RouteState != nil {
+				grp.RouteState.Release()
+			}
+			if limitErr.limited() {
+				return nil, limitErr
+			}
+			return nil, err
+		}
+
+		if rh.TryAcquire() {
+			return &core.Election{
+				RouterHost: rh,
+				Cluster:    clusters[rh.ClusterKey],
+				Route:      grp.Route,
+				RouteState: grp.RouteState,
+				ALPN:       grp.ALPN,
+			}, nil
+		}
+
+		limitErr.RouterHosts = append(limitErr.RouterHosts, rh)
+		routerHosts = withoutRouterHost(routerHosts, rh)
+	}
+}
+
+func withoutRouterHost(routerHosts []*core.RouterHost, remove *core.RouterHost) []*core.RouterHost {
+	l := make([]*core.RouterHost, 0, len(routerHosts))
+	for _, rh := range routerHosts {
+		if rh != remove {
+			l = append(l, rh)
+		}
+	}
+	return l
 }
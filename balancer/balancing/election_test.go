@@ -0,0 +1,273 @@
+package balancing
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/core"
+)
+
+func testRouterHost(cluster, name string, healthy bool, maxConnections int) *core.RouterHost {
+	rh := &core.RouterHost{ClusterKey: cluster, Name: name, MaxConnections: maxConnections}
+	rh.SetHealthy(healthy)
+	return rh
+}
+
+// testClusters returns the clusters a and b with the route app.example.com of weight 1 on
+// both and two router hosts each. The router hosts are healthy unless listed in unhealthy
+func testClusters(unhealthy ...string) map[string]*core.Cluster {
+	down := map[string]bool{}
+	for _, name := range unhealthy {
+		down[name] = true
+	}
+
+	clusters := map[string]*core.Cluster{}
+	for _, key := range []string{"a", "b"} {
+		cl := core.NewCluster(key, map[string]core.Route{"app": {URL: "app.example.com", Weight: 1}})
+		for _, name := range []string{key + "1", key + "2"} {
+			cl.RouterHosts[name] = testRouterHost(key, name, !down[name], 0)
+		}
+		clusters[key] = cl
+	}
+	return clusters
+}
+
+// deniedClusters returns testClusters where the route denies 10.0.0.0/24 on the listed clusters
+func deniedClusters(keys ...string) map[string]*core.Cluster {
+	clusters := testClusters()
+	for _, key := range keys {
+		clusters[key].SetRoutes(map[string]core.Route{
+			"app": {URL: "app.example.com", Weight: 1, MaxConnections: 1, DeniedSources: []string{"10.0.0.0/24"}},
+		})
+	}
+	return clusters
+}
+
+func TestElectRouterHost(t *testing.T) {
+	tests := []struct {
+		name     string
+		clusters map[string]*core.Cluster
+		ctx      core.Context
+
+		// want are the clusters the router host may be elected from, none expects an error
+		want   []string
+		limit  bool
+		denied bool
+	}{
+		{
+			name:     "route on all clusters",
+			clusters: testClusters(),
+			ctx:      core.Context{Hostname: "app.example.com"},
+			want:     []string{"a", "b"},
+		},
+		{
+			name:     "all router hosts of one cluster unhealthy",
+			clusters: testClusters("a1", "a2"),
+			ctx:      core.Context{Hostname: "app.example.com"},
+			want:     []string{"b"},
+		},
+		{
+			name:     "all clusters unhealthy",
+			clusters: testClusters("a1", "a2", "b1", "b2"),
+			ctx:      core.Context{Hostname: "app.example.com"},
+		},
+		{
+			name:     "unknown route",
+			clusters: testClusters("b1", "b2"),
+			ctx:      core.Context{Hostname: "unknown.example.com"},
+			want:     []string{"a"},
+		},
+		{
+			name:     "unknown route and all clusters unhealthy",
+			clusters: testClusters("a1", "a2", "b1", "b2"),
+			ctx:      core.Context{Hostname: "unknown.example.com"},
+		},
+		{
+			name:     "no route name",
+			clusters: testClusters("a1"),
+			ctx:      core.Context{},
+			want:     []string{"a", "b"},
+		},
+		{
+			name:     "cluster of the context",
+			clusters: testClusters(),
+			ctx:      core.Context{Hostname: "app.example.com", Cluster: "b"},
+			want:     []string{"b"},
+		},
+		{
+			name: "route drained on one cluster",
+			clusters: func() map[string]*core.Cluster {
+				clusters := testClusters()
+				clusters["a"].SetRoutes(map[string]core.Route{"app": {URL: "app.example.com", Weight: 0}})
+				return clusters
+			}(),
+			ctx:  core.Context{Hostname: "app.example.com"},
+			want: []string{"b"},
+		},
+		{
+			name: "route drained on all clusters",
+			clusters: func() map[string]*core.Cluster {
+				clusters := testClusters()
+				for _, cl := range clusters {
+					cl.SetRoutes(map[string]core.Route{"app": {URL: "app.example.com", Weight: 0}})
+				}
+				return clusters
+			}(),
+			ctx: core.Context{Hostname: "app.example.com"},
+		},
+		{
+			name: "router hosts at their limit",
+			clusters: func() map[string]*core.Cluster {
+				clusters := testClusters("b1", "b2")
+				for _, rh := range clusters["a"].RouterHosts {
+					rh.MaxConnections = 1
+					rh.TryAcquire()
+				}
+				return clusters
+			}(),
+			ctx:   core.Context{Hostname: "app.example.com"},
+			limit: true,
+		},
+		{
+			name: "route at its limit",
+			clusters: func() map[string]*core.Cluster {
+				clusters := map[string]*core.Cluster{"a": testClusters()["a"]}
+				clusters["a"].SetRoutes(map[string]core.Route{"app": {URL: "app.example.com", Weight: 1, MaxConnections: 1}})
+				_, state, _ := clusters["a"].Route("app.example.com")
+				state.TryAcquire(1)
+				return clusters
+			}(),
+			ctx:   core.Context{Hostname: "app.example.com"},
+			limit: true,
+		},
+		{
+			name:     "route denies the client on one cluster",
+			clusters: deniedClusters("a"),
+			ctx:      core.Context{Hostname: "app.example.com", Client: net.ParseIP("10.0.0.1")},
+			want:     []string{"b"},
+		},
+		{
+			name:     "route denies the client on all clusters",
+			clusters: deniedClusters("a", "b"),
+			ctx:      core.Context{Hostname: "app.example.com", Client: net.ParseIP("10.0.0.1")},
+			denied:   true,
+		},
+		{
+			name: "route denies the client and is at its limit",
+			clusters: func() map[string]*core.Cluster {
+				clusters := deniedClusters("a", "b")
+				for _, rh := range clusters["a"].RouterHosts {
+					rh.MaxConnections = 1
+					rh.TryAcquire()
+				}
+				return clusters
+			}(),
+			ctx:    core.Context{Hostname: "app.example.com", Client: net.ParseIP("10.0.0.1")},
+			denied: true,
+		},
+		{
+			name:     "route allows other clients",
+			clusters: deniedClusters("a", "b"),
+			ctx:      core.Context{Hostname: "app.example.com", Client: net.ParseIP("10.0.1.1")},
+			want:     []string{"a", "b"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				election, err := ElectRouterHost(tt.ctx, tt.clusters, getRouterHostWithLeastConn)
+				if tt.denied {
+					deniedErr, ok := err.(*DeniedError)
+					if !ok || len(deniedErr.RouteStates) != len(tt.clusters) {
+						t.Fatalf("expected a denied error of every cluster, got %v", err)
+					}
+					for _, rs := range deniedErr.RouteStates {
+						if rs.ActiveConnections() != 0 {
+							t.Fatal("denied client took a slot of the route")
+						}
+					}
+					continue
+				}
+				if tt.limit {
+					if _, ok := err.(*LimitError); !ok {
+						t.Fatalf("expected a limit error, got %v", err)
+					}
+					return
+				}
+				if len(tt.want) == 0 {
+					if err == nil {
+						t.Fatalf("expected an error, got router host %v", election.RouterHost.Name)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				found := false
+				for _, key := range tt.want {
+					found = found || election.RouterHost.ClusterKey == key
+				}
+				if !found || !election.RouterHost.Healthy() {
+					t.Fatalf("elected router host %v of cluster %v", election.RouterHost.Name, election.RouterHost.ClusterKey)
+				}
+				election.Release()
+			}
+		})
+	}
+}
+
+func TestGetRouterHostGroupBasedOnWeight(t *testing.T) {
+	hosts := []*core.RouterHost{testRouterHost("a", "a1", true, 0)}
+
+	tests := []struct {
+		name   string
+		groups []*RouterHostGroup
+		want   int // index of the only group that may be selected, -1 expects an error
+	}{
+		{"single group", []*RouterHostGroup{{Weight: 1, RouterHosts: hosts}}, 0},
+		{"empty group skipped", []*RouterHostGroup{{Weight: 10}, {Weight: 1, RouterHosts: hosts}}, 1},
+		{"drained group skipped", []*RouterHostGroup{{Weight: 0, RouterHosts: hosts}, {Weight: 1, RouterHosts: hosts}}, 1},
+		{"negative weight skipped", []*RouterHostGroup{{Weight: 1, RouterHosts: hosts}, {Weight: -1, RouterHosts: hosts}}, 0},
+		{"all drained", []*RouterHostGroup{{Weight: 0, RouterHosts: hosts}, {Weight: 0, RouterHosts: hosts}}, -1},
+		{"all empty", []*RouterHostGroup{{Weight: 1}, {Weight: 2}}, -1},
+		{"no groups", nil, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				grp, err := getRouterHostGroupBasedOnWeight(tt.groups)
+				if tt.want < 0 {
+					if err == nil {
+						t.Fatal("expected an error")
+					}
+					return
+				}
+				if err != nil || grp != tt.groups[tt.want] {
+					t.Fatalf("selected %+v: %v", grp, err)
+				}
+			}
+		})
+	}
+}
+
+func TestGetRouterHostGroupBasedOnWeightShares(t *testing.T) {
+	hosts := []*core.RouterHost{testRouterHost("a", "a1", true, 0)}
+	groups := []*RouterHostGroup{{Weight: 1, RouterHosts: hosts}, {Weight: 3, RouterHosts: hosts}}
+
+	const n = 40000
+	selected := map[*RouterHostGroup]int{}
+	for i := 0; i < n; i++ {
+		grp, err := getRouterHostGroupBasedOnWeight(groups)
+		if err != nil {
+			t.Fatal(err)
+		}
+		selected[grp]++
+	}
+
+	if share := float64(selected[groups[1]]) / n; share < 0.72 || share > 0.78 {
+		t.Fatalf("group of weight 3 of 4 got %.3f of the selections", share)
+	}
+}
@@ -0,0 +1,39 @@
+package balancing
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/core"
+)
+
+// minLatency is used for router hosts without measured latency, so they compete by their connections
+const minLatency = time.Microsecond
+
+// getRouterHostWithLeastLatency returns the router host with the lowest moving average of the
+// connect latency weighted by its active connections. Distant or slow router hosts only get
+// connections once the closer ones are busy enough
+func getRouterHostWithLeastLatency(routerHosts []*core.RouterHost) (*core.RouterHost, error) {
+	if len(routerHosts) == 0 {
+		return nil, errors.New("no available router hosts found")
+	}
+
+	var best *core.RouterHost
+	bestCost := 0.0
+	for _, rh := range routerHosts {
+		cost := latencyCost(rh)
+		if best == nil || cost <= bestCost {
+			best, bestCost = rh, cost
+		}
+	}
+
+	return best, nil
+}
+
+func latencyCost(rh *core.RouterHost) float64 {
+	latency := rh.LatencyEWMA()
+	if latency < minLatency {
+		latency = minLatency
+	}
+	return latency.Seconds() * float64(rh.ActiveConnections()+1)
+}
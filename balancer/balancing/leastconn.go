@@ -13,7 +13,7 @@ func getRouterHostWithLeastConn(routerHosts []*core.RouterHost) (*core.RouterHos
 
 	least := routerHosts[0]
 	for key, rh := range routerHosts {
-		if rh.LastState.ActiveConnections <= least.LastState.ActiveConnections {
+		if rh.ActiveConnections() <= least.ActiveConnections() {
 			least = routerHosts[key]
 		}
 	}
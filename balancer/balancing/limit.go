@@ -0,0 +1,32 @@
+package balancing
+
+import (
+	"fmt"
+
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/core"
+)
+
+// LimitError is returned when router hosts were available, but all of them
+// or their routes already had reached their connection limit
+type LimitError struct {
+	RouterHosts []*core.RouterHost
+	RouteStates []*core.RouteState
+}
+
+func (e *LimitError) Error() string {
+	return "all possible router hosts are at their connection limit"
+}
+
+func (e *LimitError) limited() bool {
+	return len(e.RouterHosts) > 0 || len(e.RouteStates) > 0
+}
+
+// DeniedError is returned when every cluster that serves the route denies the client
+type DeniedError struct {
+	Hostname    string
+	RouteStates []*core.RouteState
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("client is not allowed to access route '%v'", e.Hostname)
+}
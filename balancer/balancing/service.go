@@ -0,0 +1,54 @@
+package balancing
+
+import (
+	"fmt"
+
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/core"
+	"github.com/sirupsen/logrus"
+)
+
+// electServiceBackend elects a backend of the tcp service. The clusters get the
+// connections by the weight of their service, like routes.
+func electServiceBackend(service string, clusters map[string]*core.Cluster, strategy Strategy) (*core.Election, error) {
+	limitErr := &LimitError{}
+
+	var hostGroups []*RouterHostGroup
+	for _, cl := range clusters {
+		svc, ok := cl.Services[service]
+		if !ok {
+			continue
+		}
+
+		grp := &RouterHostGroup{
+			RouterHosts: availableRouterHosts(svc.Backends, limitErr),
+			Weight:      svc.Weight,
+		}
+
+		// A cluster without available backends gets no share of the weight
+		if len(grp.RouterHosts) > 0 {
+			hostGroups = append(hostGroups, grp)
+		} else {
+			logrus.Debugf("Cluster %v has service %v but no available backends", cl.Key, service)
+		}
+	}
+
+	if len(hostGroups) == 0 {
+		if limitErr.limited() {
+			return nil, limitErr
+		}
+		return nil, fmt.Errorf("can't elect backend, service %v has no healthy backends on any cluster", service)
+	}
+
+	grp, err := getRouterHostGroupBasedOnWeight(hostGroups)
+	if err != nil {
+		return nil, err
+	}
+
+	election, err := acquireRouterHost(grp, clusters, strategy, limitErr)
+	if err != nil {
+		return nil, err
+	}
+	election.Service = service
+
+	return election, nil
+}
@@ -0,0 +1,29 @@
+package balancing
+
+import (
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/core"
+)
+
+// Strategies to select a router host within the group that was chosen by weight
+const (
+	// StrategyLeastConn selects the router host with the least active connections
+	StrategyLeastConn = "leastconn"
+	// StrategyEWMA selects by active connections and the moving average of the connect latency
+	StrategyEWMA = "ewma"
+)
+
+// Strategy selects the router host for a connection
+type Strategy func(routerHosts []*core.RouterHost) (*core.RouterHost, error)
+
+// ValidStrategy returns true if name is a known strategy
+func ValidStrategy(name string) bool {
+	return name == StrategyLeastConn || name == StrategyEWMA
+}
+
+// StrategyByName returns the strategy with name. Unknown names get least connections
+func StrategyByName(name string) Strategy {
+	if name == StrategyEWMA {
+		return getRouterHostWithLeastLatency
+	}
+	return getRouterHostWithLeastConn
+}
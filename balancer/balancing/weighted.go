@@ -3,29 +3,36 @@ package balancing
 import (
 	"errors"
 	"math/rand"
-
-	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/core"
 )
 
-func getPossibleRouterHostsBasedOnWeight(hostGroups []*RouterHostGroup) ([]*core.RouterHost, error) {
+func getRouterHostGroupBasedOnWeight(hostGroups []*RouterHostGroup) (*RouterHostGroup, error) {
 	totalWeight := 0
 	for _, grp := range hostGroups {
-		if grp.Weight <= 0 {
-			return nil, errors.New("invalid route weight: 0")
+		// Empty and drained groups can't take traffic, their weight is shared by the others
+		if grp.Weight <= 0 || len(grp.RouterHosts) == 0 {
+			continue
 		}
 		totalWeight += grp.Weight
 	}
 
+	if totalWeight == 0 {
+		return nil, errors.New("no router host group with router hosts and a weight found")
+	}
+
 	r := rand.Intn(totalWeight)
 	pos := 0
 
 	for _, grp := range hostGroups {
+		if grp.Weight <= 0 || len(grp.RouterHosts) == 0 {
+			continue
+		}
+
 		pos += grp.Weight
 		if r >= pos {
 			continue
 		}
-		return grp.RouterHosts, nil
+		return grp, nil
 	}
 
 	return nil, errors.New("error selection router host group based on weight")
-}
\ No newline at end of file
+}
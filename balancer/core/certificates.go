@@ -0,0 +1,163 @@
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CertificateInfo describes a certificate of the store
+type CertificateInfo struct {
+	Hostnames []string  `json:"hostnames"`
+	NotAfter  time.Time `json:"notAfter"`
+}
+
+// CertificateStore holds the certificates to terminate TLS by hostname.
+// Wildcard certificates match one label, like *.example.com matches app.example.com.
+type CertificateStore struct {
+	certs map[string]*tls.Certificate
+	mux   sync.RWMutex
+}
+
+func NewCertificateStore() *CertificateStore {
+	return &CertificateStore{
+		certs: map[string]*tls.Certificate{},
+	}
+}
+
+// Add adds a PEM encoded certificate chain and its key for all hostnames of the certificate
+func (s *CertificateStore) Add(certPEM []byte, keyPEM []byte) ([]string, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// The names are normalized in a copy, the parsed certificate keeps its own
+	hostnames := append([]string{}, cert.Leaf.DNSNames...)
+	if len(hostnames) == 0 && len(cert.Leaf.Subject.CommonName) > 0 {
+		hostnames = []string{cert.Leaf.Subject.CommonName}
+	}
+	if len(hostnames) == 0 {
+		return nil, errors.New("certificate has no hostnames")
+	}
+
+	s.mux.Lock()
+	for i, h := range hostnames {
+		hostnames[i] = NormalizeHostname(h)
+		s.certs[hostnames[i]] = &cert
+	}
+	s.mux.Unlock()
+
+	return hostnames, nil
+}
+
+// Remove removes the certificate of hostname
+func (s *CertificateStore) Remove(hostname string) bool {
+	hostname = NormalizeHostname(hostname)
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	_, ok := s.certs[hostname]
+	delete(s.certs, hostname)
+	return ok
+}
+
+// Get returns the certificate for hostname or nil if there is none
+func (s *CertificateStore) Get(hostname string) *tls.Certificate {
+	hostname = NormalizeHostname(hostname)
+
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	if cert, ok := s.certs[hostname]; ok {
+		return cert
+	}
+
+	if i := strings.IndexByte(hostname, '.'); i != -1 {
+		if cert, ok := s.certs["*"+hostname[i:]]; ok {
+			return cert
+		}
+	}
+
+	return nil
+}
+
+// List returns all certificates by hostname
+func (s *CertificateStore) List() map[string]CertificateInfo {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	l := make(map[string]CertificateInfo, len(s.certs))
+	for h, cert := range s.certs {
+		l[h] = CertificateInfo{
+			Hostnames: cert.Leaf.DNSNames,
+			NotAfter:  cert.Leaf.NotAfter,
+		}
+	}
+	return l
+}
+
+// GetCertificate selects the certificate by SNI for a tls.Config
+func (s *CertificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := s.Get(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+	return nil, errors.New("no certificate for " + hello.ServerName)
+}
+
+// LoadDir loads all certificates of dir. A certificate is either a .pem file with the
+// chain and the key or a .crt file with a .key file of the same name.
+func (s *CertificateStore) LoadDir(dir string) error {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(dir, f.Name())
+		var certPath, keyPath string
+		switch filepath.Ext(f.Name()) {
+		case ".pem":
+			certPath, keyPath = path, path
+		case ".crt":
+			certPath, keyPath = path, strings.TrimSuffix(path, ".crt")+".key"
+		default:
+			continue
+		}
+
+		certPEM, err := os.ReadFile(certPath)
+		if err != nil {
+			return err
+		}
+		keyPEM, err := os.ReadFile(keyPath)
+		if err != nil {
+			return err
+		}
+
+		hostnames, err := s.Add(certPEM, keyPEM)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate %v: %v", certPath, err)
+		}
+		logrus.Infof("Loaded certificate %v for %v", certPath, strings.Join(hostnames, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a self signed certificate and its key for the hostnames as PEM
+func testCertificate(t *testing.T, hostnames ...string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hostnames[0]},
+		DNSNames:     hostnames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestCertificateStoreAdd(t *testing.T) {
+	certPEM, keyPEM := testCertificate(t, "App.Example.com", "www.example.com")
+
+	s := NewCertificateStore()
+	hostnames, err := s.Add(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hostnames, []string{"app.example.com", "www.example.com"}) {
+		t.Fatalf("hostnames %v", hostnames)
+	}
+
+	// The names of the parsed certificate are not changed by the normalization
+	cert := s.Get("APP.example.com")
+	if cert == nil || !reflect.DeepEqual(cert.Leaf.DNSNames, []string{"App.Example.com", "www.example.com"}) {
+		t.Fatalf("certificate %v", cert)
+	}
+}
+
+func TestCertificateStoreLoadDir(t *testing.T) {
+	dir := t.TempDir()
+	certPEM, keyPEM := testCertificate(t, "app.example.com")
+	os.WriteFile(filepath.Join(dir, "app.pem"), append(certPEM, keyPEM...), 0600)
+	certPEM, keyPEM = testCertificate(t, "api.example.com")
+	os.WriteFile(filepath.Join(dir, "api.crt"), certPEM, 0600)
+	os.WriteFile(filepath.Join(dir, "api.key"), keyPEM, 0600)
+	os.Mkdir(filepath.Join(dir, "sub.pem"), 0700)
+
+	s := NewCertificateStore()
+	if err := s.LoadDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if s.Get("app.example.com") == nil || s.Get("api.example.com") == nil || len(s.List()) != 2 {
+		t.Fatalf("loaded %v", s.List())
+	}
+
+	// A certificate that can't be loaded fails the whole directory
+	os.WriteFile(filepath.Join(dir, "broken.pem"), []byte("no certificate"), 0600)
+	if err := NewCertificateStore().LoadDir(dir); err == nil {
+		t.Fatal("directory with a broken certificate was loaded")
+	}
+}
@@ -0,0 +1,257 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+const (
+	recordTypeHandshake      = 22
+	handshakeTypeClientHello = 1
+
+	recordHeaderLen    = 5
+	handshakeHeaderLen = 4
+	maxRecordLen       = 1 << 14
+	maxClientHelloLen  = 1 << 16
+
+	extensionServerName        = 0
+	extensionALPN              = 16
+	extensionSupportedVersions = 43
+)
+
+var (
+	// ErrNotTLS is returned if the client does not start with a TLS handshake
+	ErrNotTLS = errors.New("not a TLS handshake")
+
+	errClientHelloTooLarge = errors.New("TLS ClientHello is too large")
+	errMalformedHello      = errors.New("malformed TLS ClientHello")
+)
+
+// ClientHello is the information of a TLS ClientHello that is used for routing
+type ClientHello struct {
+	// ServerName is the SNI hostname, empty if the client sent none
+	ServerName string
+
+	// ALPNProtocols are the application protocols offered by the client, like h2 and http/1.1
+	ALPNProtocols []string
+
+	// Version is the legacy version of the hello, SupportedVersions the versions of the
+	// supported_versions extension that TLS 1.3 clients send
+	Version           uint16
+	SupportedVersions []uint16
+
+	CipherSuites []uint16
+}
+
+// ReadClientHello reads and parses the ClientHello at the start of r. The handshake message
+// may be fragmented over any number of records, its size is limited by maxClientHelloLen
+func ReadClientHello(r io.Reader) (*ClientHello, error) {
+	var msg []byte
+	header := make([]byte, recordHeaderLen)
+
+	for first := true; ; first = false {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+
+		if header[0] != recordTypeHandshake {
+			if first {
+				return nil, ErrNotTLS
+			}
+			return nil, errMalformedHello
+		}
+
+		length := int(binary.BigEndian.Uint16(header[3:5]))
+		if length == 0 || length > maxRecordLen {
+			return nil, errMalformedHello
+		}
+
+		start := len(msg)
+		msg = append(msg, make([]byte, length)...)
+		if _, err := io.ReadFull(r, msg[start:]); err != nil {
+			return nil, err
+		}
+
+		if len(msg) < handshakeHeaderLen {
+			continue
+		}
+		if msg[0] != handshakeTypeClientHello {
+			return nil, errMalformedHello
+		}
+		n := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+		if n > maxClientHelloLen {
+			return nil, errClientHelloTooLarge
+		}
+		if len(msg) >= handshakeHeaderLen+n {
+			return parseClientHello(msg[handshakeHeaderLen : handshakeHeaderLen+n])
+		}
+	}
+}
+
+// parseClientHello parses the body of a ClientHello handshake message
+func parseClientHello(data []byte) (*ClientHello, error) {
+	s := helloReader(data)
+	hello := &ClientHello{}
+
+	var ok bool
+	if hello.Version, ok = s.uint16(); !ok {
+		return nil, errMalformedHello
+	}
+
+	// random and session id
+	var sessionID helloReader
+	if !s.skip(32) || !s.readUint8Prefixed(&sessionID) {
+		return nil, errMalformedHello
+	}
+
+	var ciphers helloReader
+	if !s.readUint16Prefixed(&ciphers) || len(ciphers)%2 != 0 {
+		return nil, errMalformedHello
+	}
+	for len(ciphers) > 0 {
+		c, _ := ciphers.uint16()
+		hello.CipherSuites = append(hello.CipherSuites, c)
+	}
+
+	var compression helloReader
+	if !s.readUint8Prefixed(&compression) {
+		return nil, errMalformedHello
+	}
+
+	// Extensions are optional
+	if len(s) == 0 {
+		return hello, nil
+	}
+
+	var extensions helloReader
+	if !s.readUint16Prefixed(&extensions) || len(s) != 0 {
+		return nil, errMalformedHello
+	}
+
+	for len(extensions) > 0 {
+		var ext helloReader
+		typ, ok := extensions.uint16()
+		if !ok || !extensions.readUint16Prefixed(&ext) {
+			return nil, errMalformedHello
+		}
+
+		var err error
+		switch typ {
+		case extensionServerName:
+			hello.ServerName, err = parseServerName(ext)
+		case extensionALPN:
+			hello.ALPNProtocols, err = parseALPN(ext)
+		case extensionSupportedVersions:
+			hello.SupportedVersions, err = parseSupportedVersions(ext)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return hello, nil
+}
+
+func parseServerName(ext helloReader) (string, error) {
+	var names helloReader
+	if !ext.readUint16Prefixed(&names) || len(ext) != 0 {
+		return "", errMalformedHello
+	}
+
+	for len(names) > 0 {
+		var name helloReader
+		typ, ok := names.uint8()
+		if !ok || !names.readUint16Prefixed(&name) {
+			return "", errMalformedHello
+		}
+		// host_name is the only defined type
+		if typ == 0 {
+			return strings.TrimSpace(string(name)), nil
+		}
+	}
+
+	return "", nil
+}
+
+func parseALPN(ext helloReader) ([]string, error) {
+	var list helloReader
+	if !ext.readUint16Prefixed(&list) || len(ext) != 0 {
+		return nil, errMalformedHello
+	}
+
+	var protocols []string
+	for len(list) > 0 {
+		var proto helloReader
+		if !list.readUint8Prefixed(&proto) || len(proto) == 0 {
+			return nil, errMalformedHello
+		}
+		protocols = append(protocols, string(proto))
+	}
+
+	return protocols, nil
+}
+
+func parseSupportedVersions(ext helloReader) ([]uint16, error) {
+	var list helloReader
+	if !ext.readUint8Prefixed(&list) || len(ext) != 0 || len(list)%2 != 0 {
+		return nil, errMalformedHello
+	}
+
+	var versions []uint16
+	for len(list) > 0 {
+		v, _ := list.uint16()
+		versions = append(versions, v)
+	}
+
+	return versions, nil
+}
+
+// helloReader reads the length prefixed fields of a handshake message
+type helloReader []byte
+
+func (r *helloReader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *helloReader) uint8() (uint8, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *helloReader) uint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+func (r *helloReader) readUint8Prefixed(out *helloReader) bool {
+	n, ok := r.uint8()
+	return ok && r.readBytes(int(n), out)
+}
+
+func (r *helloReader) readUint16Prefixed(out *helloReader) bool {
+	n, ok := r.uint16()
+	return ok && r.readBytes(int(n), out)
+}
+
+func (r *helloReader) readBytes(n int, out *helloReader) bool {
+	if len(*r) < n {
+		return false
+	}
+	*out = (*r)[:n]
+	*r = (*r)[n:]
+	return true
+}
@@ -0,0 +1,170 @@
+package core
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureClientHello returns the first flight of a crypto/tls client, a ClientHello in a single record
+func captureClientHello(tb testing.TB, cfg *tls.Config) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, cfg).Handshake()
+		client.Close()
+	}()
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, recordHeaderLen)
+	if _, err := io.ReadFull(server, header); err != nil {
+		tb.Fatal(err)
+	}
+	record := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(server, record); err != nil {
+		tb.Fatal(err)
+	}
+	return append(header, record...)
+}
+
+// fragment splits the handshake message of a single record hello into records of n bytes
+func fragment(hello []byte, n int) []byte {
+	msg := hello[recordHeaderLen:]
+	var out []byte
+	for len(msg) > 0 {
+		k := n
+		if k > len(msg) {
+			k = len(msg)
+		}
+		out = append(out, recordTypeHandshake, hello[1], hello[2], byte(k>>8), byte(k))
+		out = append(out, msg[:k]...)
+		msg = msg[k:]
+	}
+	return out
+}
+
+// sniffSegmented sends data in TCP segments of n bytes followed by rest through Sniff
+func sniffSegmented(data []byte, n int, rest string) (net.Conn, *ClientHello, error) {
+	client, server := net.Pipe()
+	go func() {
+		for b := data; len(b) > 0; {
+			k := n
+			if k > len(b) {
+				k = len(b)
+			}
+			if _, err := client.Write(b[:k]); err != nil {
+				return
+			}
+			b = b[k:]
+		}
+		client.Write([]byte(rest))
+		client.Close()
+	}()
+	return Sniff(server, 5*time.Second)
+}
+
+var helloConfigs = map[string]*tls.Config{
+	"tls13":  {ServerName: "App.example.com", NextProtos: []string{"h2", "http/1.1"}},
+	"tls12":  {ServerName: "app.example.com", MaxVersion: tls.VersionTLS12},
+	"no-sni": {InsecureSkipVerify: true},
+}
+
+func TestReadClientHello(t *testing.T) {
+	for name, cfg := range helloConfigs {
+		hello := captureClientHello(t, cfg)
+		for _, n := range []int{1, 7, 100, maxRecordLen} {
+			h, err := ReadClientHello(bytes.NewReader(fragment(hello, n)))
+			if err != nil {
+				t.Fatalf("%v in records of %v bytes: %v", name, n, err)
+			}
+			if h.ServerName != cfg.ServerName || len(h.ALPNProtocols) != len(cfg.NextProtos) ||
+				len(h.CipherSuites) == 0 {
+				t.Fatalf("%v in records of %v bytes: %+v", name, n, h)
+			}
+		}
+	}
+}
+
+// A large hello in records of one byte has five times more record headers than payload
+func TestReadClientHelloManyRecords(t *testing.T) {
+	var protos []string
+	for i := 0; i < 60; i++ {
+		protos = append(protos, strings.Repeat(string(rune('a'+i%26)), 250))
+	}
+	hello := captureClientHello(t, &tls.Config{ServerName: "app.example.com", NextProtos: protos})
+
+	h, err := ReadClientHello(bytes.NewReader(fragment(hello, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.ServerName != "app.example.com" || len(h.ALPNProtocols) != len(protos) {
+		t.Fatalf("%+v", h)
+	}
+}
+
+func TestReadClientHelloErrors(t *testing.T) {
+	hello := captureClientHello(t, helloConfigs["tls13"])
+
+	if _, err := ReadClientHello(strings.NewReader("GET / HTTP/1.1\r\n\r\n")); err != ErrNotTLS {
+		t.Fatal(err)
+	}
+	if _, err := ReadClientHello(bytes.NewReader(fragment(hello, 1)[:300])); err == nil {
+		t.Fatal("truncated hello was parsed")
+	}
+
+	tooLarge := []byte{recordTypeHandshake, 3, 1, 0, 4, handshakeTypeClientHello, 2, 0, 0}
+	if _, err := ReadClientHello(bytes.NewReader(tooLarge)); err != errClientHelloTooLarge {
+		t.Fatal(err)
+	}
+}
+
+func TestSniffSegmented(t *testing.T) {
+	hello := captureClientHello(t, helloConfigs["tls13"])
+	for _, data := range [][]byte{hello, fragment(hello, 10)} {
+		for _, n := range []int{1, 3, 512} {
+			conn, h, err := sniffSegmented(data, n, "rest")
+			if err != nil || h.ServerName != "App.example.com" {
+				t.Fatal(err, h)
+			}
+
+			replayed, err := io.ReadAll(conn)
+			if err != nil || !bytes.Equal(replayed, append(append([]byte{}, data...), "rest"...)) {
+				t.Fatalf("segments of %v bytes were not replayed: %v", n, err)
+			}
+		}
+	}
+}
+
+// The corpus in testdata/fuzz adds captured hellos of curl (OpenSSL 3.0) and of crypto/tls with an
+// X25519MLKEM768 key share and ECH, and that hello with the GREASE values and extensions of Chrome.
+// The large hellos are also split in TCP segments and records inside the key share
+func FuzzReadClientHello(f *testing.F) {
+	for _, cfg := range helloConfigs {
+		hello := captureClientHello(f, cfg)
+		f.Add(hello, 0)
+		f.Add(fragment(hello, 1), 3)
+		f.Add(fragment(hello, 50), 17)
+	}
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n"), 1)
+
+	f.Fuzz(func(t *testing.T, data []byte, segment int) {
+		h, err := ReadClientHello(bytes.NewReader(data))
+		if err == nil && h == nil {
+			t.Fatal("no hello and no error")
+		}
+
+		// Sniff has to replay exactly what it read, whether the hello was valid or not
+		if segment <= 0 || segment > len(data) {
+			segment = len(data) + 1
+		}
+		conn, _, _ := sniffSegmented(data, segment, "")
+		replayed, err := io.ReadAll(conn)
+		if err != nil || !bytes.Equal(replayed, data) {
+			t.Fatalf("replayed %q, sent %q: %v", replayed, data, err)
+		}
+	})
+}
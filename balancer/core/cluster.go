@@ -1,40 +1,213 @@
 package core
 
-import "github.com/sirupsen/logrus"
+import (
+	"net"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TLS termination modes of a route on the balancer
+const (
+	// TLSPassthrough forwards the TLS connection to the router host based on SNI
+	TLSPassthrough = ""
+	// TLSEdge terminates TLS on the balancer and sends plain http to the router host
+	TLSEdge = "edge"
+	// TLSReencrypt terminates TLS on the balancer and opens a new TLS connection to the router host
+	TLSReencrypt = "reencrypt"
+)
+
+// ALPN modes of a route
+const (
+	// ALPNPrefer balances to router hosts that support the protocol of the client if there are any
+	ALPNPrefer = "prefer"
+	// ALPNRequire only balances to router hosts that support the protocol of the client
+	ALPNRequire = "require"
+)
 
 type Route struct {
 	URL    string `json:"url"`
 	Weight int    `json:"weight"`
+
+	// TLSTermination defines if the balancer terminates TLS for the route. See TLS* for the modes.
+	// TLS is only terminated if the balancer has a certificate for the route
+	TLSTermination string `json:"tlsTermination"`
+
+	// MaxConnections limits the concurrent connections to this route on the cluster. 0 means no limit
+	MaxConnections int `json:"maxConnections"`
+
+	// ALPN are the application protocols the route is balanced by on https passthrough connections.
+	// ALPNMode defines if router hosts supporting the protocol of the client are preferred or required
+	ALPN     []string `json:"alpn"`
+	ALPNMode string   `json:"alpnMode"`
+
+	// Client ips or CIDRs that may or may not use the route. An empty allow list allows everyone
+	AllowedSources []string `json:"allowedSources"`
+	DeniedSources  []string `json:"deniedSources"`
+	sources        *SourceFilter
+}
+
+// ALPNProtocol returns the first protocol offered by the client that the route is balanced by
+func (r *Route) ALPNProtocol(clientProtocols []string) string {
+	for _, cp := range clientProtocols {
+		for _, p := range r.ALPN {
+			if cp == p {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// SourceAllowed returns true if a client with ip may use the route
+func (r *Route) SourceAllowed(ip net.IP) bool {
+	return r.sources.Allowed(ip)
 }
 
 type Cluster struct {
 	Key         string
 	RouterHosts map[string]*RouterHost
 	Routes      map[string]Route
+
+	// RouteStates holds the live state of every route by hostname. It is kept over route updates
+	RouteStates map[string]*RouteState
+
+	// routeKeys are the keys of the Routes by hostname. The map is replaced, never changed,
+	// so the copies of the cluster share it
+	routeKeys map[string]string
+
+	// ProxyProtocol is the PROXY protocol version sent to the router hosts. Empty uses the balancer default
+	ProxyProtocol string
+
+	// Services are the tcp services of the cluster by name
+	Services map[string]*ClusterService
 }
 
 type ClusterUpdate struct {
-	Routes      map[string]Route  `json:"routes"`
-	RouterHosts map[string]RouterHost `json:"routerHosts"`
+	Routes        map[string]Route      `json:"routes"`
+	RouterHosts   map[string]RouterHost `json:"routerHosts"`
+	ProxyProtocol string                `json:"proxyProtocol"`
+	Services      map[string]Service    `json:"services"`
 }
 
 func NewCluster(key string, routes map[string]Route) *Cluster {
+	c := &Cluster{
+		Key:         key,
+		RouterHosts: map[string]*RouterHost{},
+		RouteStates: map[string]*RouteState{},
+		Services:    map[string]*ClusterService{},
+	}
+	c.SetRoutes(routes)
+
+	return c
+}
+
+// SetRoutes replaces the routes of the cluster. The state of routes that still exist is kept
+func (c *Cluster) SetRoutes(routes map[string]Route) {
 	// Verify routes
-	for _, r := range routes {
-		if len(r.URL) == 0 || r.Weight <= 0 {
+	for key, r := range routes {
+		// A weight of 0 drains the route on the cluster
+		if len(r.URL) == 0 || r.Weight < 0 {
 			logrus.Error("Invalid cluster config!")
 		}
+
+		if r.TLSTermination != TLSPassthrough && r.TLSTermination != TLSEdge && r.TLSTermination != TLSReencrypt {
+			logrus.Errorf("Invalid TLS termination '%v' of route %v, using passthrough", r.TLSTermination, r.URL)
+			r.TLSTermination = TLSPassthrough
+			routes[key] = r
+		}
+
+		if len(r.ALPNMode) == 0 {
+			r.ALPNMode = ALPNPrefer
+			routes[key] = r
+		} else if r.ALPNMode != ALPNPrefer && r.ALPNMode != ALPNRequire {
+			logrus.Errorf("Invalid ALPN mode '%v' of route %v, using %v", r.ALPNMode, r.URL, ALPNPrefer)
+			r.ALPNMode = ALPNPrefer
+			routes[key] = r
+		}
+
+		if len(r.AllowedSources) > 0 || len(r.DeniedSources) > 0 {
+			r.sources = NewSourceFilter(r.AllowedSources, r.DeniedSources)
+			routes[key] = r
+		}
 	}
 
-	return &Cluster{
-		Key:         key,
-		RouterHosts: map[string]*RouterHost{},
-		Routes:      routes,
+	states := make(map[string]*RouteState, len(routes))
+	keys := make(map[string]string, len(routes))
+	for name, r := range routes {
+		key := NormalizeHostname(r.URL)
+		if existing, ok := c.RouteStates[key]; ok {
+			states[key] = existing
+		} else {
+			states[key] = &RouteState{}
+		}
+		keys[key] = name
+	}
+
+	c.Routes = routes
+	c.RouteStates = states
+	c.routeKeys = keys
+}
+
+// Route returns the route of the cluster that serves hostname and its state
+func (c *Cluster) Route(hostname string) (*Route, *RouteState, bool) {
+	key := NormalizeHostname(hostname)
+	name, ok := c.routeKeys[key]
+	if !ok {
+		return nil, nil, false
+	}
+
+	route := c.Routes[name]
+	return &route, c.RouteStates[key], true
+}
+
+// Copy returns a copy of the cluster that does not share its maps with the original
+func (c *Cluster) Copy() *Cluster {
+	cp := &Cluster{
+		Key:           c.Key,
+		RouterHosts:   make(map[string]*RouterHost, len(c.RouterHosts)),
+		Routes:        make(map[string]Route, len(c.Routes)),
+		RouteStates:   make(map[string]*RouteState, len(c.RouteStates)),
+		ProxyProtocol: c.ProxyProtocol,
+		Services:      make(map[string]*ClusterService, len(c.Services)),
+		routeKeys:     c.routeKeys,
+	}
+
+	for k, rh := range c.RouterHosts {
+		cp.RouterHosts[k] = rh
+	}
+	for k, r := range c.Routes {
+		cp.Routes[k] = r
 	}
+	for k, rs := range c.RouteStates {
+		cp.RouteStates[k] = rs
+	}
+	for k, svc := range c.Services {
+		cp.Services[k] = svc.Copy()
+	}
+
+	return cp
+}
+
+// SetProxyProtocol sets the PROXY protocol version for the router hosts of the cluster
+func (c *Cluster) SetProxyProtocol(version string) {
+	if !ValidProxyProtocol(version) {
+		logrus.Errorf("Invalid PROXY protocol version '%v' for cluster %v, using the default", version, c.Key)
+		version = ""
+	}
+	c.ProxyProtocol = version
 }
 
 func (c *Cluster) Stop() {
 	for _, rh := range c.RouterHosts {
 		rh.Stop()
 	}
+	for _, svc := range c.Services {
+		svc.Stop()
+	}
+}
+
+// NormalizeHostname returns the hostname in the form that is used to compare routes
+func NormalizeHostname(hostname string) string {
+	return strings.ToLower(strings.TrimSpace(hostname))
 }
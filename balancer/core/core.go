@@ -3,22 +3,60 @@ package core
 import (
 	"bufio"
 	"net"
+	"time"
 )
 
-// MaxTicks defines the length of the stats for the UI
-const MaxTicks = 40
-
 type Context struct {
 	HTTPS    bool
 	Hostname string
 	Conn     BufferedConn
+
+	// Service is the tcp service of the listener that accepted the connection. Empty for http and https
+	Service string
+
+	// Cluster restricts the election to one cluster if it is set
+	Cluster string
+
+	// ALPN are the application protocols offered by a https client
+	ALPN []string
+
+	// Terminated is true if the balancer terminated TLS and Conn carries plain http
+	Terminated bool
+
+	// Accepted is the time the listener accepted the client connection
+	Accepted time.Time
+
+	// Client is the ip of the client. It is checked against the allow and deny lists of the route
+	Client net.IP
+}
+
+// PlainHTTP returns true if the client sends plain http, also after the balancer terminated TLS
+func (c *Context) PlainHTTP() bool {
+	return len(c.Service) == 0 && (!c.HTTPS || c.Terminated)
 }
 
 type HostStats struct {
-	Healthy            bool   `json:"healthy"`
-	TotalConnections   int64  `json:"totalConnections"`
-	ActiveConnections  uint   `json:"activeConnections"`
-	RefusedConnections uint64 `json:"refusedConnections"`
+	Healthy             bool   `json:"healthy"`
+	TotalConnections    int64  `json:"totalConnections"`
+	ActiveConnections   uint   `json:"activeConnections"`
+	RefusedConnections  uint64 `json:"refusedConnections"`
+	RejectedConnections uint64 `json:"rejectedConnections"`
+	TrafficStats
+}
+
+// TrafficStats are the bytes proxied from the clients (in) and to the clients (out)
+// and the throughput in bytes per second since the previous tick
+type TrafficStats struct {
+	BytesIn       uint64  `json:"bytesIn"`
+	BytesOut      uint64  `json:"bytesOut"`
+	ThroughputIn  float64 `json:"throughputIn"`
+	ThroughputOut float64 `json:"throughputOut"`
+}
+
+// Traffic are the proxied bytes per cluster and per route hostname
+type Traffic struct {
+	Clusters map[string]TrafficStats
+	Routes   map[string]TrafficStats
 }
 
 type RouterHostWithStats struct {
@@ -27,20 +65,50 @@ type RouterHostWithStats struct {
 	HTTPPort   int         `json:"httpPort"`
 	HTTPSPort  int         `json:"httpsPort"`
 	Stats      []HostStats `json:"stats"`
+
+	// Latency are the timing histograms of the router host since the start of the balancer
+	Latency LatencyStats `json:"latency"`
 }
 
+// GlobalStats are the series for the UI. Ticks are the RFC3339 times of the samples
 type GlobalStats struct {
 	Mutation           string                         `json:"mutation"`
 	Hosts              map[string]RouterHostWithStats `json:"hosts"`
 	Ticks              []string                       `json:"ticks"`
 	OverallConnections []uint                         `json:"overallConnections"`
+	RateLimited        []uint64                       `json:"rateLimited"`
+	PlainHTTPOnHTTPS   []uint64                       `json:"plainHttpOnHttps"`
+	MissingSNI         []uint64                       `json:"missingSni"`
+	Clusters           map[string][]TrafficStats      `json:"clusters"`
+	Routes             map[string][]TrafficStats      `json:"routes"`
+	RouteStats         map[string]RouteStats          `json:"routeStats"`
 	UnhealthyHosts     []int                          `json:"unhealthyHosts"`
 	HealthyHosts       []int                          `json:"healthyHosts"`
 }
 
+// HistorySample is one sample of the router hosts and routes in the stats history and in stats events
+type HistorySample struct {
+	Time        time.Time               `json:"time"`
+	Connections uint                    `json:"connections"`
+	Hosts       map[string]HistoryHost  `json:"hosts,omitempty"`
+	Routes      map[string]HistoryRoute `json:"routes,omitempty"`
+}
+
+type HistoryHost struct {
+	ClusterKey string `json:"clusterKey"`
+	HostIP     string `json:"hostIP"`
+	HostStats
+}
+
+type HistoryRoute struct {
+	TrafficStats
+	Clusters map[string]RouteClusterStats `json:"clusters,omitempty"`
+}
+
+// ReadWriteCount are the bytes read from and written to the client of a connection
 type ReadWriteCount struct {
-	CountRead  uint
-	CountWrite uint
+	CountRead  uint64
+	CountWrite uint64
 }
 
 func (rwc ReadWriteCount) IsZero() bool {
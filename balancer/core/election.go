@@ -0,0 +1,45 @@
+package core
+
+// Election is the result of electing a router host for a connection.
+// The election holds a connection slot on the router host and the route until it is released.
+type Election struct {
+	RouterHost *RouterHost
+	Cluster    *Cluster
+
+	// Route and RouteState are nil if the connection was not balanced based on a route
+	Route      *Route
+	RouteState *RouteState
+
+	// Service is the tcp service the backend was elected for. Empty for router hosts
+	Service string
+
+	// ALPN is the application protocol the router host was elected for. Empty if ALPN was not considered
+	ALPN string
+
+	// Retries is the number of elections that were repeated while the connection waited in the queue
+	Retries int
+}
+
+// AddBytesIn counts bytes sent by the client to the elected router host
+func (e *Election) AddBytesIn(n int) {
+	e.RouterHost.AddBytesIn(n)
+	if e.RouteState != nil {
+		e.RouteState.AddBytesIn(n)
+	}
+}
+
+// AddBytesOut counts bytes sent by the elected router host to the client
+func (e *Election) AddBytesOut(n int) {
+	e.RouterHost.AddBytesOut(n)
+	if e.RouteState != nil {
+		e.RouteState.AddBytesOut(n)
+	}
+}
+
+// Release frees the connection slots held by the election
+func (e *Election) Release() {
+	e.RouterHost.Release()
+	if e.RouteState != nil {
+		e.RouteState.Release()
+	}
+}
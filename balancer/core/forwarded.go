@@ -0,0 +1,302 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Modes to add forwarding headers to plain http requests
+const (
+	ForwardedHeadersNone  = "none"
+	ForwardedHeadersFirst = "first"
+	ForwardedHeadersAll   = "all"
+)
+
+// maxRequestHeadSize limits the request line and headers of a request that is rewritten
+const maxRequestHeadSize = 64 << 10
+
+var errRequestHeadTooLarge = errors.New("http request head too large")
+
+// ValidForwardedHeadersMode returns true if mode is a known forwarding headers mode
+func ValidForwardedHeadersMode(mode string) bool {
+	switch mode {
+	case ForwardedHeadersNone, ForwardedHeadersFirst, ForwardedHeadersAll:
+		return true
+	}
+	return false
+}
+
+// ForwardedInfo describes the client side of a connection for the forwarding headers
+type ForwardedInfo struct {
+	ClientAddr net.Addr
+	LocalAddr  net.Addr
+	Proto      string
+}
+
+// values returns the values for the X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Port and Forwarded headers.
+// The port is empty if the local address has none.
+func (fi ForwardedInfo) values(host string) (xff string, proto string, port string, forwarded string) {
+	clientIP := AddrIP(fi.ClientAddr)
+
+	forwarded = "for=" + forwardedNode(clientIP) + ";proto=" + fi.Proto
+	if len(host) > 0 {
+		forwarded += ";host=" + forwardedValue(host)
+	}
+
+	if _, p, err := net.SplitHostPort(fi.LocalAddr.String()); err == nil {
+		port = p
+	}
+
+	xff = "unknown"
+	if clientIP != nil {
+		xff = clientIP.String()
+	}
+
+	return xff, fi.Proto, port, forwarded
+}
+
+// headers returns the header lines to add to a request. X-Forwarded-For and
+// Forwarded are appended to existing ones, the others replace them.
+func (fi ForwardedInfo) headers(host string) []string {
+	xff, proto, port, forwarded := fi.values(host)
+
+	l := []string{
+		"X-Forwarded-For: " + xff,
+		"X-Forwarded-Proto: " + proto,
+		"Forwarded: " + forwarded,
+	}
+	if len(port) > 0 {
+		l = append(l, "X-Forwarded-Port: "+port)
+	}
+
+	return l
+}
+
+// SetHeaders adds the forwarding headers to h the same way as for rewritten requests
+func (fi ForwardedInfo) SetHeaders(h http.Header, host string) {
+	xff, proto, port, forwarded := fi.values(host)
+
+	h.Add("X-Forwarded-For", xff)
+	h.Add("Forwarded", forwarded)
+	h.Set("X-Forwarded-Proto", proto)
+	if len(port) > 0 {
+		h.Set("X-Forwarded-Port", port)
+	} else {
+		h.Del("X-Forwarded-Port")
+	}
+}
+
+func forwardedNode(ip net.IP) string {
+	if ip == nil {
+		return "unknown"
+	}
+	if ip.To4() == nil {
+		return `"[` + ip.String() + `]"`
+	}
+	return ip.String()
+}
+
+// forwardedValue quotes v if it contains characters that are not allowed in a token (RFC 7230)
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", c) && !('0' <= c && c <= '9') &&
+			!('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') {
+			return strconv.Quote(v)
+		}
+	}
+	return v
+}
+
+// ProxyHTTPRequests copies the requests from a plain http client to the router host and adds
+// the forwarding headers to the first or every request. Everything after the rewritten requests,
+// the request bodies and upgraded connections are copied as they are.
+func ProxyHTTPRequests(to BufferedConn, from BufferedConn, info ForwardedInfo, everyRequest bool, count CountFunc) <-chan uint64 {
+	doneChan := make(chan uint64, 1)
+
+	go func() {
+		cw := &countingWriter{w: to, count: count}
+		err := copyHTTPRequests(cw, from, info, everyRequest)
+		e, ok := err.(*net.OpError)
+		if err != nil && (!ok || e.Err.Error() != "use of closed network connection") {
+			logrus.Warn(err)
+		}
+
+		to.Close()
+		from.Close()
+
+		doneChan <- cw.total
+	}()
+
+	return doneChan
+}
+
+func copyHTTPRequests(to io.Writer, from BufferedConn, info ForwardedInfo, everyRequest bool) error {
+	for {
+		head, err := readRequestHead(from.Reader)
+		if err != nil {
+			if err == io.EOF && len(head) == 0 {
+				return nil
+			}
+
+			// Not something that can be rewritten, forward it untouched
+			if _, err := to.Write(head); err != nil {
+				return err
+			}
+			return copyData(to, from)
+		}
+
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+		if err != nil {
+			if _, err := to.Write(head); err != nil {
+				return err
+			}
+			return copyData(to, from)
+		}
+
+		if _, err := to.Write(addForwardedHeaders(head, info.headers(req.Host))); err != nil {
+			return err
+		}
+
+		// Only the first request is changed or the connection is no longer http
+		if !everyRequest || req.Method == http.MethodConnect || len(req.Header.Get("Upgrade")) > 0 {
+			return copyData(to, from)
+		}
+
+		if err := copyRequestBody(to, from.Reader, req); err != nil {
+			return err
+		}
+	}
+}
+
+// readRequestHead reads the request line and headers including the empty line that ends them
+func readRequestHead(br *bufio.Reader) ([]byte, error) {
+	head := []byte{}
+
+	first, err := br.Peek(1)
+	if err != nil {
+		return head, err
+	}
+	if first[0] < 'A' || first[0] > 'Z' {
+		// Doesn't look like an HTTP verb
+		return head, errors.New("not an http request")
+	}
+
+	for {
+		line, err := br.ReadSlice('\n')
+		head = append(head, line...)
+		if err == bufio.ErrBufferFull {
+			if len(head) > maxRequestHeadSize {
+				return head, errRequestHeadTooLarge
+			}
+			continue
+		}
+		if err != nil {
+			return head, err
+		}
+
+		if bytes.Equal(line, crlf) || bytes.Equal(line, lf) {
+			return head, nil
+		}
+		if len(head) > maxRequestHeadSize {
+			return head, errRequestHeadTooLarge
+		}
+	}
+}
+
+// addForwardedHeaders adds the header lines to the request head. Existing
+// headers that are replaced by the new lines are removed.
+func addForwardedHeaders(head []byte, headers []string) []byte {
+	replaced := map[string]bool{
+		"x-forwarded-proto": true,
+		"x-forwarded-port":  true,
+	}
+
+	lines := bytes.SplitAfter(head, lf)
+	out := make([]byte, 0, len(head)+256)
+
+	// Request line
+	out = append(out, lines[0]...)
+
+	for _, line := range lines[1:] {
+		if len(bytes.TrimSpace(line)) == 0 {
+			break
+		}
+
+		if i := bytes.IndexByte(line, ':'); i > 0 && replaced[strings.ToLower(string(line[:i]))] {
+			continue
+		}
+		out = append(out, line...)
+	}
+
+	for _, h := range headers {
+		out = append(out, h...)
+		out = append(out, crlf...)
+	}
+
+	return append(out, crlf...)
+}
+
+// copyRequestBody copies the body of req from br without changing it
+func copyRequestBody(to io.Writer, br *bufio.Reader, req *http.Request) error {
+	if len(req.TransferEncoding) > 0 && req.TransferEncoding[0] == "chunked" {
+		return copyChunkedBody(to, br)
+	}
+
+	if req.ContentLength > 0 {
+		_, err := io.CopyN(to, br, req.ContentLength)
+		return err
+	}
+
+	return nil
+}
+
+// copyChunkedBody copies a chunked body including its trailers
+func copyChunkedBody(to io.Writer, br *bufio.Reader) error {
+	for {
+		line, err := br.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+		if _, err := to.Write(line); err != nil {
+			return err
+		}
+
+		sizeField := string(bytes.TrimSpace(line))
+		if i := strings.IndexByte(sizeField, ';'); i != -1 {
+			sizeField = sizeField[:i]
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+		if err != nil {
+			return err
+		}
+
+		if size == 0 {
+			// Trailers until the empty line
+			for {
+				line, err := br.ReadSlice('\n')
+				if err != nil {
+					return err
+				}
+				if _, err := to.Write(line); err != nil {
+					return err
+				}
+				if len(bytes.TrimSpace(line)) == 0 {
+					return nil
+				}
+			}
+		}
+
+		// Chunk data and its CRLF
+		if _, err := io.CopyN(to, br, size+2); err != nil {
+			return err
+		}
+	}
+}
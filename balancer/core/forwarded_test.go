@@ -0,0 +1,202 @@
+package core
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var (
+	forwardedV4 = ForwardedInfo{
+		ClientAddr: &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 51000},
+		LocalAddr:  &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8080},
+		Proto:      "http",
+	}
+	forwardedV6 = ForwardedInfo{
+		ClientAddr: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 51000},
+		LocalAddr:  &net.TCPAddr{IP: net.ParseIP("::1"), Port: 8443},
+		Proto:      "https",
+	}
+)
+
+func TestForwardedInfoSetHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		info     ForwardedInfo
+		host     string
+		existing http.Header
+		want     http.Header
+	}{
+		{
+			name: "ipv4",
+			info: forwardedV4,
+			host: "app.example.com",
+			want: http.Header{
+				"X-Forwarded-For":   {"192.168.1.10"},
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Port":  {"8080"},
+				"Forwarded":         {"for=192.168.1.10;proto=http;host=app.example.com"},
+			},
+		},
+		{
+			name: "ipv6 is quoted",
+			info: forwardedV6,
+			host: "app.example.com",
+			want: http.Header{
+				"X-Forwarded-For":   {"::1"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Port":  {"8443"},
+				"Forwarded":         {`for="[::1]";proto=https;host=app.example.com`},
+			},
+		},
+		{
+			name: "host with port is quoted",
+			info: forwardedV4,
+			host: "app.example.com:8080",
+			want: http.Header{
+				"X-Forwarded-For":   {"192.168.1.10"},
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Port":  {"8080"},
+				"Forwarded":         {`for=192.168.1.10;proto=http;host="app.example.com:8080"`},
+			},
+		},
+		{
+			name: "without host",
+			info: forwardedV4,
+			want: http.Header{
+				"X-Forwarded-For":   {"192.168.1.10"},
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Port":  {"8080"},
+				"Forwarded":         {"for=192.168.1.10;proto=http"},
+			},
+		},
+		{
+			name: "chains are appended, proto and port replaced",
+			info: forwardedV4,
+			host: "app.example.com",
+			existing: http.Header{
+				"X-Forwarded-For":   {"203.0.113.1, 198.51.100.1"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Port":  {"443"},
+				"Forwarded":         {"for=203.0.113.1;proto=https"},
+			},
+			want: http.Header{
+				"X-Forwarded-For":   {"203.0.113.1, 198.51.100.1", "192.168.1.10"},
+				"X-Forwarded-Proto": {"http"},
+				"X-Forwarded-Port":  {"8080"},
+				"Forwarded":         {"for=203.0.113.1;proto=https", "for=192.168.1.10;proto=http;host=app.example.com"},
+			},
+		},
+		{
+			name: "unknown client and local address without port",
+			info: ForwardedInfo{ClientAddr: &net.UnixAddr{Name: "@client"}, LocalAddr: &net.UnixAddr{Name: "@balancer"}, Proto: "http"},
+			existing: http.Header{
+				"X-Forwarded-Port": {"443"},
+			},
+			want: http.Header{
+				"X-Forwarded-For":   {"unknown"},
+				"X-Forwarded-Proto": {"http"},
+				"Forwarded":         {"for=unknown;proto=http"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tt.existing {
+				h[k] = append([]string{}, v...)
+			}
+
+			tt.info.SetHeaders(h, tt.host)
+			if !reflect.DeepEqual(h, tt.want) {
+				t.Fatalf("got %v, expected %v", h, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddForwardedHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		info ForwardedInfo
+		want string
+	}{
+		{
+			name: "new headers",
+			head: "GET / HTTP/1.1\r\nHost: app.example.com\r\n\r\n",
+			info: forwardedV4,
+			want: "GET / HTTP/1.1\r\nHost: app.example.com\r\n" +
+				"X-Forwarded-For: 192.168.1.10\r\nX-Forwarded-Proto: http\r\n" +
+				"Forwarded: for=192.168.1.10;proto=http;host=app.example.com\r\nX-Forwarded-Port: 8080\r\n\r\n",
+		},
+		{
+			name: "chains are appended, proto and port replaced",
+			head: "GET / HTTP/1.1\r\nHost: app.example.com\r\nX-Forwarded-For: 203.0.113.1\r\n" +
+				"x-forwarded-proto: http\r\nX-Forwarded-Port: 80\r\nForwarded: for=203.0.113.1\r\n\r\n",
+			info: forwardedV6,
+			want: "GET / HTTP/1.1\r\nHost: app.example.com\r\nX-Forwarded-For: 203.0.113.1\r\nForwarded: for=203.0.113.1\r\n" +
+				"X-Forwarded-For: ::1\r\nX-Forwarded-Proto: https\r\n" +
+				"Forwarded: for=\"[::1]\";proto=https;host=app.example.com\r\nX-Forwarded-Port: 8443\r\n\r\n",
+		},
+		{
+			name: "bare line feeds",
+			head: "GET / HTTP/1.1\nHost: app.example.com\n\n",
+			info: forwardedV4,
+			want: "GET / HTTP/1.1\nHost: app.example.com\n" +
+				"X-Forwarded-For: 192.168.1.10\r\nX-Forwarded-Proto: http\r\n" +
+				"Forwarded: for=192.168.1.10;proto=http;host=app.example.com\r\nX-Forwarded-Port: 8080\r\n\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(addForwardedHeaders([]byte(tt.head), tt.info.headers("app.example.com")))
+			if got != tt.want {
+				t.Fatalf("got %q, expected %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyHTTPRequests(t *testing.T) {
+	requests := "POST /a HTTP/1.1\r\nHost: app.example.com\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n" +
+		"GET /b HTTP/1.1\r\nHost: app.example.com\r\nContent-Length: 2\r\n\r\nhi" +
+		"GET /c HTTP/1.1\r\nHost: app.example.com\r\n\r\n"
+
+	tests := []struct {
+		name         string
+		everyRequest bool
+		rewritten    int
+	}{
+		{"first request", false, 1},
+		{"every request", true, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			go func() {
+				client.Write([]byte(requests))
+				client.Close()
+			}()
+
+			out := &bytes.Buffer{}
+			if err := copyHTTPRequests(out, NewBufferedConn(server), forwardedV4, tt.everyRequest); err != nil {
+				t.Fatal(err)
+			}
+
+			got := out.String()
+			if n := strings.Count(got, "X-Forwarded-For: 192.168.1.10\r\n"); n != tt.rewritten {
+				t.Fatalf("%v requests rewritten, expected %v: %q", n, tt.rewritten, got)
+			}
+			if !strings.Contains(got, "3\r\nabc\r\n0\r\n\r\n") || !strings.Contains(got, "\r\n\r\nhiGET /c") {
+				t.Fatalf("bodies were changed: %q", got)
+			}
+		})
+	}
+}
@@ -11,6 +11,9 @@ import (
 type HealthCheckResult struct {
 	RouterHost *RouterHost
 	Healthy    bool
+
+	// Latency is the time it took to connect or to fail
+	Latency time.Duration
 }
 
 type HealthCheck struct {
@@ -18,7 +21,7 @@ type HealthCheck struct {
 	checkPort  int
 
 	interval time.Duration
-	ticker   time.Ticker
+	ticker   *time.Ticker
 	stop     chan bool
 	status   chan HealthCheckResult
 }
@@ -39,7 +42,7 @@ func NewHealthCheck(routerHost *RouterHost, checkPort int,
 func (hc *HealthCheck) Start() {
 	logrus.Infof("Starting health checks for router host %v:%v", hc.routerHost.HostIP, hc.checkPort)
 
-	hc.ticker = *time.NewTicker(hc.interval)
+	hc.ticker = time.NewTicker(hc.interval)
 
 	go func() {
 		for {
@@ -54,8 +57,6 @@ func (hc *HealthCheck) Start() {
 			}
 		}
 	}()
-
-	select {}
 }
 
 func (hc *HealthCheck) Stop() {
@@ -64,7 +65,9 @@ func (hc *HealthCheck) Stop() {
 }
 
 func checkRouterHost(hc *HealthCheck) {
+	start := time.Now()
 	conn, err := net.DialTimeout("tcp", hc.routerHost.HostIP+":"+strconv.Itoa(hc.checkPort), 5*time.Second)
+	latency := time.Since(start)
 
 	var healthy bool
 	if err != nil {
@@ -78,5 +81,6 @@ func checkRouterHost(hc *HealthCheck) {
 	hc.status <- HealthCheckResult{
 		RouterHost: hc.routerHost,
 		Healthy:    healthy,
+		Latency:    latency,
 	}
 }
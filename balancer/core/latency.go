@@ -0,0 +1,102 @@
+package core
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the dial and time to first byte histograms
+var LatencyBuckets = []time.Duration{
+	time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond, 10 * time.Millisecond,
+	25 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond,
+	500 * time.Millisecond, time.Second, 2500 * time.Millisecond, 5 * time.Second,
+}
+
+// LifetimeBuckets are the upper bounds of the connection lifetime histogram
+var LifetimeBuckets = []time.Duration{
+	100 * time.Millisecond, time.Second, 5 * time.Second, 15 * time.Second, 30 * time.Second,
+	time.Minute, 5 * time.Minute, 15 * time.Minute, time.Hour, 4 * time.Hour,
+}
+
+// Histogram counts durations in buckets. It is only changed atomically
+type Histogram struct {
+	bounds []time.Duration
+
+	// counts has one more bucket for durations above the last bound
+	counts []uint64
+	sum    int64
+}
+
+func NewHistogram(bounds []time.Duration) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(h.bounds) && d > h.bounds[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// HistogramStats is a copy of a histogram. Counts are per bucket, the last
+// one counts the durations above the last bound. Bounds and Sum are in seconds
+type HistogramStats struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"`
+	Count  uint64    `json:"count"`
+	Sum    float64   `json:"sum"`
+}
+
+func (h *Histogram) Stats() HistogramStats {
+	s := HistogramStats{
+		Bounds: make([]float64, len(h.bounds)),
+		Counts: make([]uint64, len(h.counts)),
+		Sum:    time.Duration(atomic.LoadInt64(&h.sum)).Seconds(),
+	}
+	for i, b := range h.bounds {
+		s.Bounds[i] = b.Seconds()
+	}
+	for i := range h.counts {
+		s.Counts[i] = atomic.LoadUint64(&h.counts[i])
+		s.Count += s.Counts[i]
+	}
+	return s
+}
+
+// Latency are the timing histograms of the connections to a router host
+type Latency struct {
+	// Dial is the time to connect to the router host
+	Dial *Histogram
+	// TimeToFirstByte is the time from accepting the client, including the hostname
+	// sniffing, until the connection to the router host is ready to forward the first byte
+	TimeToFirstByte *Histogram
+	// Lifetime is the time from accepting the client until the connection is closed
+	Lifetime *Histogram
+}
+
+func NewLatency() *Latency {
+	return &Latency{
+		Dial:            NewHistogram(LatencyBuckets),
+		TimeToFirstByte: NewHistogram(LatencyBuckets),
+		Lifetime:        NewHistogram(LifetimeBuckets),
+	}
+}
+
+type LatencyStats struct {
+	Dial            HistogramStats `json:"dial"`
+	TimeToFirstByte HistogramStats `json:"timeToFirstByte"`
+	Lifetime        HistogramStats `json:"lifetime"`
+}
+
+func (l *Latency) Stats() LatencyStats {
+	return LatencyStats{
+		Dial:            l.Dial.Stats(),
+		TimeToFirstByte: l.TimeToFirstByte.Stats(),
+		Lifetime:        l.Lifetime.Stats(),
+	}
+}
@@ -0,0 +1,106 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SourceFilter allows or denies clients based on their ip address
+type SourceFilter struct {
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+
+	// restricted is true if there is an allow list, even if none of its entries are valid
+	restricted bool
+}
+
+// NewSourceFilter creates a filter from lists of CIDRs or ip addresses. Invalid entries are skipped.
+// An allow list without valid entries allows no client
+func NewSourceFilter(allowed []string, denied []string) *SourceFilter {
+	return &SourceFilter{
+		allowed:    parseNetworks(allowed),
+		denied:     parseNetworks(denied),
+		restricted: len(strings.Fields(strings.Join(allowed, " "))) > 0,
+	}
+}
+
+// Allowed returns false if ip is denied or there is an allow list that does not contain ip
+func (f *SourceFilter) Allowed(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+
+	if ip == nil {
+		return !f.restricted && len(f.denied) == 0
+	}
+
+	for _, n := range f.denied {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	if !f.restricted {
+		return true
+	}
+	for _, n := range f.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseNetworks(l []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, entry := range l {
+		// Entries can be space separated like in the ip_whitelist annotation of the OpenShift router
+		for _, s := range strings.Fields(entry) {
+			n, err := ParseNetwork(s)
+			if err != nil {
+				logrus.Errorf("Ignoring invalid network '%v': %v", s, err)
+				continue
+			}
+			networks = append(networks, n)
+		}
+	}
+	return networks
+}
+
+// ParseNetwork parses a CIDR or a single ip address
+func ParseNetwork(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip address '%v'", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
+
+// AddrIP returns the ip address of addr or nil if it has none
+func AddrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
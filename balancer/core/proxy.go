@@ -11,11 +11,35 @@ const (
 	bufferSize = 16 * 1024
 )
 
-func Proxy(to BufferedConn, from BufferedConn) <-chan bool {
-	doneChan := make(chan bool)
+// CountFunc is called with the number of bytes after every write of a proxy
+type CountFunc func(n int)
+
+// countingWriter reports the bytes written to w
+type countingWriter struct {
+	w     io.Writer
+	count CountFunc
+	total uint64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	if n > 0 {
+		cw.total += uint64(n)
+		if cw.count != nil {
+			cw.count(n)
+		}
+	}
+	return n, err
+}
+
+// Proxy copies from one connection to the other until one of them is closed.
+// The channel receives the number of bytes written to the destination.
+func Proxy(to BufferedConn, from BufferedConn, count CountFunc) <-chan uint64 {
+	doneChan := make(chan uint64, 1)
 
 	go func() {
-		err := copyData(to, from)
+		cw := &countingWriter{w: to, count: count}
+		err := copyData(cw, from)
 		e, ok := err.(*net.OpError)
 		if err != nil && (!ok || e.Err.Error() != "use of closed network connection") {
 			logrus.Warn(err)
@@ -24,7 +48,7 @@ func Proxy(to BufferedConn, from BufferedConn) <-chan bool {
 		to.Close()
 		from.Close()
 
-		doneChan <- true
+		doneChan <- cw.total
 	}()
 
 	return doneChan
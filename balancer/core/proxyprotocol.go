@@ -0,0 +1,265 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Versions of the PROXY protocol that can be sent to router hosts
+const (
+	ProxyProtocolNone = "none"
+	ProxyProtocolV1   = "v1"
+	ProxyProtocolV2   = "v2"
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ValidProxyProtocol returns true if v is a known PROXY protocol version or empty
+func ValidProxyProtocol(v string) bool {
+	switch v {
+	case "", ProxyProtocolNone, ProxyProtocolV1, ProxyProtocolV2:
+		return true
+	}
+	return false
+}
+
+// WriteProxyProtocolHeader writes a PROXY protocol header for a connection from src to dst.
+// Addresses that are not TCP or of different ip families are sent as unknown.
+func WriteProxyProtocolHeader(w io.Writer, version string, src net.Addr, dst net.Addr) error {
+	var header []byte
+	switch version {
+	case ProxyProtocolV1:
+		header = proxyProtocolV1Header(src, dst)
+	case ProxyProtocolV2:
+		header = proxyProtocolV2Header(src, dst)
+	default:
+		return nil
+	}
+
+	_, err := w.Write(header)
+	return err
+}
+
+// tcpAddrs returns both addresses as TCP addresses of the same ip family
+func tcpAddrs(src net.Addr, dst net.Addr) (*net.TCPAddr, *net.TCPAddr, bool) {
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 || (s.IP.To4() == nil) != (d.IP.To4() == nil) {
+		return nil, nil, false
+	}
+	return s, d, true
+}
+
+func proxyProtocolV1Header(src net.Addr, dst net.Addr) []byte {
+	s, d, ok := tcpAddrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	proto := "TCP6"
+	if s.IP.To4() != nil {
+		proto = "TCP4"
+	}
+
+	return []byte(fmt.Sprintf("PROXY %v %v %v %v %v\r\n", proto, s.IP, d.IP, s.Port, d.Port))
+}
+
+func proxyProtocolV2Header(src net.Addr, dst net.Addr) []byte {
+	buf := &bytes.Buffer{}
+	buf.Write(proxyProtocolV2Signature)
+
+	// Version 2, PROXY command
+	buf.WriteByte(0x21)
+
+	s, d, ok := tcpAddrs(src, dst)
+	if !ok {
+		// Unspecified family, the receiver uses the real connection addresses
+		buf.Write([]byte{0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+
+	srcIP, dstIP := s.IP.To4(), d.IP.To4()
+	if srcIP != nil {
+		// TCP over IPv4
+		buf.WriteByte(0x11)
+		binary.Write(buf, binary.BigEndian, uint16(12))
+	} else {
+		// TCP over IPv6
+		srcIP, dstIP = s.IP.To16(), d.IP.To16()
+		buf.WriteByte(0x21)
+		binary.Write(buf, binary.BigEndian, uint16(36))
+	}
+
+	buf.Write(srcIP)
+	buf.Write(dstIP)
+	binary.Write(buf, binary.BigEndian, uint16(s.Port))
+	binary.Write(buf, binary.BigEndian, uint16(d.Port))
+
+	return buf.Bytes()
+}
+
+// ProxyProtocolConn is a client connection that arrived with a PROXY protocol header.
+// RemoteAddr and LocalAddr return the addresses of the header.
+type ProxyProtocolConn struct {
+	BufferedConn
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *ProxyProtocolConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *ProxyProtocolConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// ReadProxyProtocolHeader reads a PROXY protocol v1 or v2 header from conn if it starts with one.
+// The returned connection reports the client addresses of the header. Connections without
+// a header or with a header without addresses keep their own addresses.
+func ReadProxyProtocolHeader(conn net.Conn, readTimeout time.Duration) (net.Conn, error) {
+	bufConn := NewBufferedConn(conn)
+
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	// Look at as little as possible, a client without header might wait for the server
+	first, err := bufConn.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	var src, dst net.Addr
+	switch first[0] {
+	case 'P':
+		if b, err := bufConn.Peek(6); err != nil || string(b) != "PROXY " {
+			return bufConn, nil
+		}
+		src, dst, err = readProxyProtocolV1(bufConn.Reader)
+
+	case proxyProtocolV2Signature[0]:
+		if b, err := bufConn.Peek(len(proxyProtocolV2Signature)); err != nil || !bytes.Equal(b, proxyProtocolV2Signature) {
+			return bufConn, nil
+		}
+		src, dst, err = readProxyProtocolV2(bufConn.Reader)
+
+	default:
+		return bufConn, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if src == nil || dst == nil {
+		return bufConn, nil
+	}
+
+	return &ProxyProtocolConn{
+		BufferedConn: bufConn,
+		remoteAddr:   src,
+		localAddr:    dst,
+	}, nil
+}
+
+func readProxyProtocolV1(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	// The longest possible v1 header has 107 bytes
+	line, err := br.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, crlf) {
+		return nil, nil, errors.New("invalid PROXY protocol v1 header")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid PROXY protocol v1 header: %q", line)
+	}
+
+	src, err := parseProxyProtocolV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyProtocolV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return src, dst, nil
+}
+
+func parseProxyProtocolV1Addr(ip string, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil {
+		return nil, fmt.Errorf("invalid ip address in PROXY protocol header: %v", ip)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in PROXY protocol header: %v", port)
+	}
+	addr.Port = int(p)
+
+	return addr, nil
+}
+
+func readProxyProtocolV2(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, nil, err
+	}
+
+	verCmd, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+
+	if verCmd>>4 != 2 {
+		return nil, nil, fmt.Errorf("invalid PROXY protocol v2 version: %v", verCmd>>4)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, nil, err
+	}
+
+	// LOCAL command, the connection was not proxied
+	if verCmd&0x0f == 0 {
+		return nil, nil, nil
+	}
+
+	var ipLen int
+	switch family {
+	case 0x11:
+		// TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21:
+		// TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		// Other families are kept as unknown, the addresses are only used for tcp
+		return nil, nil, nil
+	}
+
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, errors.New("PROXY protocol v2 header too short for its address family")
+	}
+
+	src := &net.TCPAddr{
+		IP:   net.IP(payload[0:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen : 2*ipLen+2])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2 : 2*ipLen+4])),
+	}
+
+	return src, dst, nil
+}
@@ -0,0 +1,196 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readHeader sends data through ReadProxyProtocolHeader and closes the client side afterwards
+func readHeader(data []byte) (net.Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	return ReadProxyProtocolHeader(server, time.Second)
+}
+
+// withTLVs appends TLVs to a v2 header and adjusts its length
+func withTLVs(header []byte, tlvs ...[]byte) []byte {
+	h := append([]byte{}, header...)
+	for _, tlv := range tlvs {
+		h = append(h, tlv...)
+	}
+	binary.BigEndian.PutUint16(h[14:16], uint16(len(h)-16))
+	return h
+}
+
+func tlv(typ byte, value string) []byte {
+	return append([]byte{typ, byte(len(value) >> 8), byte(len(value))}, value...)
+}
+
+var (
+	tcp4Src = &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 51000}
+	tcp4Dst = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}
+	tcp6Src = &net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 51000}
+	tcp6Dst = &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 8443}
+)
+
+func TestProxyProtocolRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		src     net.Addr
+		dst     net.Addr
+		tlvs    [][]byte
+
+		// proxied is false if the connection keeps its own addresses
+		proxied bool
+	}{
+		{name: "v1 tcp4", version: ProxyProtocolV1, src: tcp4Src, dst: tcp4Dst, proxied: true},
+		{name: "v1 tcp6", version: ProxyProtocolV1, src: tcp6Src, dst: tcp6Dst, proxied: true},
+		{name: "v1 mixed families", version: ProxyProtocolV1, src: tcp4Src, dst: tcp6Dst},
+		{name: "v1 unknown", version: ProxyProtocolV1, src: &net.UDPAddr{}, dst: tcp4Dst},
+		{name: "v2 ipv4", version: ProxyProtocolV2, src: tcp4Src, dst: tcp4Dst, proxied: true},
+		{name: "v2 ipv6", version: ProxyProtocolV2, src: tcp6Src, dst: tcp6Dst, proxied: true},
+		{name: "v2 unspecified", version: ProxyProtocolV2, src: tcp6Src, dst: tcp4Dst},
+		{
+			name: "v2 ipv4 with tlvs", version: ProxyProtocolV2, src: tcp4Src, dst: tcp4Dst, proxied: true,
+			tlvs: [][]byte{tlv(0x01, "h2"), tlv(0x02, "app.example.com"), tlv(0x04, "")},
+		},
+		{
+			name: "v2 ipv6 with tlvs", version: ProxyProtocolV2, src: tcp6Src, dst: tcp6Dst, proxied: true,
+			tlvs: [][]byte{tlv(0x05, strings.Repeat("x", 300))},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := &bytes.Buffer{}
+			if err := WriteProxyProtocolHeader(header, tt.version, tt.src, tt.dst); err != nil {
+				t.Fatal(err)
+			}
+			data := header.Bytes()
+			if len(tt.tlvs) > 0 {
+				data = withTLVs(data, tt.tlvs...)
+			}
+
+			conn, err := readHeader(append(data, "GET / HTTP/1.1\r\n"...))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, proxied := conn.(*ProxyProtocolConn)
+			if proxied != tt.proxied {
+				t.Fatalf("proxied %v, expected %v", proxied, tt.proxied)
+			}
+			if tt.proxied && (conn.RemoteAddr().String() != tt.src.String() || conn.LocalAddr().String() != tt.dst.String()) {
+				t.Fatalf("addresses %v and %v, expected %v and %v", conn.RemoteAddr(), conn.LocalAddr(), tt.src, tt.dst)
+			}
+
+			rest, err := io.ReadAll(conn)
+			if err != nil || string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Fatalf("read %q after the header: %v", rest, err)
+			}
+		})
+	}
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	v2Local := append(append([]byte{}, proxyProtocolV2Signature...), 0x20, 0x00, 0x00, 0x00)
+
+	tests := []struct {
+		name string
+		data []byte
+
+		// err expects an error, otherwise the connection has to keep its own addresses
+		err bool
+	}{
+		{name: "no header", data: []byte("GET / HTTP/1.1\r\n\r\n")},
+		{name: "starts like v1", data: []byte("PROXIMITY\r\n")},
+		{name: "starts like v2", data: []byte("\r\n\r\nGET")},
+		{name: "v2 local", data: v2Local},
+		{name: "v2 local with tlvs", data: withTLVs(v2Local, tlv(0x01, "http/1.1"))},
+		{name: "v1 over the length limit", data: []byte("PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n"), err: true},
+		{name: "v1 without line end", data: []byte("PROXY TCP4 " + strings.Repeat("1", 5000)), err: true},
+		{name: "v1 without cr", data: []byte("PROXY TCP4 1.1.1.1 2.2.2.2 1 2\n"), err: true},
+		{name: "v1 missing fields", data: []byte("PROXY TCP4 1.1.1.1 2.2.2.2 1\r\n"), err: true},
+		{name: "v1 invalid ip", data: []byte("PROXY TCP4 1.1.1 2.2.2.2 1 2\r\n"), err: true},
+		{name: "v1 invalid port", data: []byte("PROXY TCP4 1.1.1.1 2.2.2.2 1 65536\r\n"), err: true},
+		{name: "v1 unknown protocol", data: []byte("PROXY UDP4 1.1.1.1 2.2.2.2 1 2\r\n"), err: true},
+		{name: "v2 invalid version", data: append(append([]byte{}, proxyProtocolV2Signature...), 0x11, 0x11, 0x00, 0x00), err: true},
+		{
+			name: "v2 address too short for family",
+			data: append(append([]byte{}, proxyProtocolV2Signature...), 0x21, 0x21, 0x00, 0x0c, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12),
+			err:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := readHeader(tt.data)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, proxied := conn.(*ProxyProtocolConn); proxied {
+				t.Fatalf("connection got the addresses %v and %v", conn.RemoteAddr(), conn.LocalAddr())
+			}
+		})
+	}
+}
+
+// Every truncated header fails or keeps the addresses of the connection, it never panics
+func TestReadProxyProtocolHeaderTruncated(t *testing.T) {
+	for _, version := range []string{ProxyProtocolV1, ProxyProtocolV2} {
+		for _, src := range []net.Addr{tcp4Src, tcp6Src} {
+			dst := tcp4Dst
+			if src == tcp6Src {
+				dst = tcp6Dst
+			}
+			header := &bytes.Buffer{}
+			WriteProxyProtocolHeader(header, version, src, dst)
+			data := header.Bytes()
+			if version == ProxyProtocolV2 {
+				data = withTLVs(data, tlv(0x02, "app.example.com"))
+			}
+
+			for n := 1; n < len(data); n++ {
+				conn, err := readHeader(data[:n])
+				if err != nil {
+					continue
+				}
+				if _, proxied := conn.(*ProxyProtocolConn); proxied {
+					t.Fatalf("%v header of %v truncated to %v bytes was read", version, src, n)
+				}
+			}
+		}
+	}
+}
+
+// A client that stops in the middle of the header is closed after the read timeout
+func TestReadProxyProtocolHeaderTimeout(t *testing.T) {
+	for _, data := range []string{"PROXY TCP4 1.1.1.1", string(proxyProtocolV2Signature) + "\x21\x11\x00\x0c\x01"} {
+		client, server := net.Pipe()
+		go client.Write([]byte(data))
+
+		started := time.Now()
+		if _, err := ReadProxyProtocolHeader(server, 100*time.Millisecond); err == nil {
+			t.Fatalf("header %q was read", data)
+		}
+		if time.Since(started) > 2*time.Second {
+			t.Fatalf("header %q was read for %v", data, time.Since(started))
+		}
+		client.Close()
+	}
+}
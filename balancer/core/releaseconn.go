@@ -0,0 +1,22 @@
+package core
+
+import "net"
+
+// ReleaseConn calls release when the connection is closed
+type ReleaseConn struct {
+	net.Conn
+	release func()
+}
+
+func NewReleaseConn(c net.Conn, release func()) *ReleaseConn {
+	return &ReleaseConn{
+		Conn:    c,
+		release: release,
+	}
+}
+
+func (c *ReleaseConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
+}
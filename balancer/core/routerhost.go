@@ -1,27 +1,64 @@
 package core
 
 import (
+	"math"
+	"sync/atomic"
 	"time"
 )
 
+// latencyEWMAWeight is the weight of a new latency sample in the moving average of a router host
+const latencyEWMAWeight = 0.3
+
 type RouterHost struct {
-	ClusterKey  string
-	Name      string `json:"name"`
-	HostIP      string `json:"hostIP"`
-	HTTPPort    int    `json:"httpPort"`
-	HTTPSPort   int    `json:"httpsPort"`
-	LastState   HostStats
+	// State is read by the elections and updated concurrently, so it is only
+	// accessed atomically. Keep the 64-bit counters first for alignment.
+	activeConnections   int64
+	totalConnections    int64
+	refusedConnections  uint64
+	rejectedConnections uint64
+	bytesIn             uint64
+	bytesOut            uint64
+	latencyEWMA         uint64 // float64 bits of the average in seconds
+	healthy             int32
+
+	ClusterKey string
+	Name       string `json:"name"`
+	HostIP     string `json:"hostIP"`
+	HTTPPort   int    `json:"httpPort"`
+	HTTPSPort  int    `json:"httpsPort"`
+
+	// Port and HealthCheckPort are used instead of the http ports if the host is the backend of a service
+	Port            int `json:"port"`
+	HealthCheckPort int `json:"healthCheckPort"`
+
+	// MaxConnections limits the concurrent connections to the router host. 0 means no limit
+	MaxConnections int `json:"maxConnections"`
+
+	// ALPN are the application protocols the router host supports on its https port, like h2
+	ALPN []string `json:"alpn"`
+
+	// ALPNPorts are dedicated https ports of the router host by application protocol
+	ALPNPorts map[string]int `json:"alpnPorts"`
+
+	// latency is shared with the snapshots of the router host. It is nil for
+	// router hosts that were not created by NewRouterHost or NewServiceBackend
+	latency *Latency
+
+	// settings holds the *routerHostSettings of the last Update. Until then
+	// MaxConnections, ALPN and ALPNPorts are used
+	settings atomic.Value
+
 	healthCheck *HealthCheck
 }
 
 func NewRouterHost(name string, ip string, httpPort int, httpsPort int, s chan HealthCheckResult, clusterKey string) *RouterHost {
 	rh := &RouterHost{
-		Name: name,
+		Name:       name,
 		ClusterKey: clusterKey,
 		HostIP:     ip,
 		HTTPPort:   httpPort,
 		HTTPSPort:  httpsPort,
-		LastState:  HostStats{},
+		latency:    NewLatency(),
 	}
 
 	rh.healthCheck = NewHealthCheck(rh, rh.HTTPPort, s, 1*time.Second)
@@ -31,10 +68,256 @@ func NewRouterHost(name string, ip string, httpPort int, httpsPort int, s chan H
 	return rh
 }
 
+// NewServiceBackend creates a backend of a tcp service. It is checked on healthCheckPort or on port if that is 0
+func NewServiceBackend(name string, ip string, port int, healthCheckPort int, s chan HealthCheckResult, clusterKey string) *RouterHost {
+	if healthCheckPort == 0 {
+		healthCheckPort = port
+	}
+
+	be := &RouterHost{
+		Name:            name,
+		ClusterKey:      clusterKey,
+		HostIP:          ip,
+		Port:            port,
+		HealthCheckPort: healthCheckPort,
+		latency:         NewLatency(),
+	}
+
+	be.healthCheck = NewHealthCheck(be, be.HealthCheckPort, s, 1*time.Second)
+
+	go be.Start()
+
+	return be
+}
+
 func (rh *RouterHost) Start() {
 	rh.healthCheck.Start()
 }
 
+// Stop stops the health checks. Router hosts that were not created by NewRouterHost
+// or NewServiceBackend have none
 func (rh *RouterHost) Stop() {
-	rh.healthCheck.Stop()
+	if rh.healthCheck != nil {
+		rh.healthCheck.Stop()
+	}
+}
+
+// routerHostSettings are the settings of a router host that can change while it is elected
+type routerHostSettings struct {
+	maxConnections int
+	alpn           []string
+	alpnPorts      map[string]int
+}
+
+func (rh *RouterHost) currentSettings() routerHostSettings {
+	if s, ok := rh.settings.Load().(*routerHostSettings); ok {
+		return *s
+	}
+	return routerHostSettings{maxConnections: rh.MaxConnections, alpn: rh.ALPN, alpnPorts: rh.ALPNPorts}
+}
+
+// Update replaces the connection limit and the application protocols of the router host.
+// They are read by concurrent elections, so the fields of the router host are not changed
+func (rh *RouterHost) Update(maxConnections int, alpn []string, alpnPorts map[string]int) {
+	rh.settings.Store(&routerHostSettings{maxConnections: maxConnections, alpn: alpn, alpnPorts: alpnPorts})
+}
+
+// Limit returns the current connection limit. 0 means no limit
+func (rh *RouterHost) Limit() int {
+	return rh.currentSettings().maxConnections
+}
+
+// LastState returns a copy of the current state of the router host
+func (rh *RouterHost) LastState() HostStats {
+	return HostStats{
+		Healthy:             rh.Healthy(),
+		TotalConnections:    atomic.LoadInt64(&rh.totalConnections),
+		ActiveConnections:   uint(atomic.LoadInt64(&rh.activeConnections)),
+		RefusedConnections:  atomic.LoadUint64(&rh.refusedConnections),
+		RejectedConnections: atomic.LoadUint64(&rh.rejectedConnections),
+		TrafficStats: TrafficStats{
+			BytesIn:  rh.BytesIn(),
+			BytesOut: rh.BytesOut(),
+		},
+	}
+}
+
+// Snapshot returns a copy of the router host that is safe to hand to other goroutines
+func (rh *RouterHost) Snapshot() RouterHost {
+	settings := rh.currentSettings()
+	return RouterHost{
+		activeConnections:   atomic.LoadInt64(&rh.activeConnections),
+		totalConnections:    atomic.LoadInt64(&rh.totalConnections),
+		refusedConnections:  atomic.LoadUint64(&rh.refusedConnections),
+		rejectedConnections: atomic.LoadUint64(&rh.rejectedConnections),
+		bytesIn:             atomic.LoadUint64(&rh.bytesIn),
+		bytesOut:            atomic.LoadUint64(&rh.bytesOut),
+		latencyEWMA:         atomic.LoadUint64(&rh.latencyEWMA),
+		healthy:             atomic.LoadInt32(&rh.healthy),
+
+		ClusterKey:     rh.ClusterKey,
+		Name:           rh.Name,
+		HostIP:         rh.HostIP,
+		HTTPPort:       rh.HTTPPort,
+		HTTPSPort:      rh.HTTPSPort,
+		Port:           rh.Port,
+		MaxConnections: settings.maxConnections,
+		ALPN:           settings.alpn,
+		ALPNPorts:      settings.alpnPorts,
+
+		latency: rh.latency,
+	}
+}
+
+// SupportsALPN returns true if the router host supports the application protocol
+func (rh *RouterHost) SupportsALPN(proto string) bool {
+	settings := rh.currentSettings()
+	if _, ok := settings.alpnPorts[proto]; ok {
+		return true
+	}
+	for _, p := range settings.alpn {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTPSPortFor returns the https port of the router host for the application protocol
+func (rh *RouterHost) HTTPSPortFor(proto string) int {
+	if port, ok := rh.currentSettings().alpnPorts[proto]; ok && port > 0 {
+		return port
+	}
+	return rh.HTTPSPort
+}
+
+func (rh *RouterHost) Healthy() bool {
+	return atomic.LoadInt32(&rh.healthy) == 1
+}
+
+func (rh *RouterHost) SetHealthy(healthy bool) {
+	var v int32
+	if healthy {
+		v = 1
+	}
+	atomic.StoreInt32(&rh.healthy, v)
+}
+
+func (rh *RouterHost) ActiveConnections() int64 {
+	return atomic.LoadInt64(&rh.activeConnections)
+}
+
+// AtLimit returns true if the router host has no free connection slot left
+func (rh *RouterHost) AtLimit() bool {
+	limit := rh.Limit()
+	return limit > 0 && rh.ActiveConnections() >= int64(limit)
+}
+
+// TryAcquire reserves a connection slot if the router host is below its limit
+func (rh *RouterHost) TryAcquire() bool {
+	return tryAcquire(&rh.activeConnections, rh.Limit())
+}
+
+func (rh *RouterHost) Release() {
+	atomic.AddInt64(&rh.activeConnections, -1)
+}
+
+func (rh *RouterHost) IncrementConnection() {
+	atomic.AddInt64(&rh.totalConnections, 1)
+}
+
+func (rh *RouterHost) IncrementRefused() {
+	atomic.AddUint64(&rh.refusedConnections, 1)
+}
+
+func (rh *RouterHost) IncrementRejected() {
+	atomic.AddUint64(&rh.rejectedConnections, 1)
+}
+
+// AddBytesIn counts bytes sent by clients to the router host
+func (rh *RouterHost) AddBytesIn(n int) {
+	atomic.AddUint64(&rh.bytesIn, uint64(n))
+}
+
+// AddBytesOut counts bytes sent by the router host to clients
+func (rh *RouterHost) AddBytesOut(n int) {
+	atomic.AddUint64(&rh.bytesOut, uint64(n))
+}
+
+func (rh *RouterHost) BytesIn() uint64 {
+	return atomic.LoadUint64(&rh.bytesIn)
+}
+
+func (rh *RouterHost) BytesOut() uint64 {
+	return atomic.LoadUint64(&rh.bytesOut)
+}
+
+// ObserveDial records the time it took to connect to the router host
+func (rh *RouterHost) ObserveDial(d time.Duration) {
+	rh.UpdateLatencyEWMA(d)
+	if rh.latency != nil {
+		rh.latency.Dial.Observe(d)
+	}
+}
+
+// ObserveDialError adds a failed connect to the moving average as the time it took, but at least
+// as timeout, so router hosts that refuse connections get fewer of them like slow ones
+func (rh *RouterHost) ObserveDialError(d time.Duration, timeout time.Duration) {
+	if d < timeout {
+		d = timeout
+	}
+	rh.UpdateLatencyEWMA(d)
+}
+
+// UpdateLatencyEWMA adds a connect latency sample to the exponentially weighted moving average
+func (rh *RouterHost) UpdateLatencyEWMA(d time.Duration) {
+	for {
+		old := atomic.LoadUint64(&rh.latencyEWMA)
+		avg := math.Float64frombits(old)
+		if old == 0 {
+			avg = d.Seconds()
+		} else {
+			avg = latencyEWMAWeight*d.Seconds() + (1-latencyEWMAWeight)*avg
+		}
+		if atomic.CompareAndSwapUint64(&rh.latencyEWMA, old, math.Float64bits(avg)) {
+			return
+		}
+	}
+}
+
+// LatencyEWMA returns the moving average of the connect latency. 0 if it was never measured
+func (rh *RouterHost) LatencyEWMA() time.Duration {
+	return time.Duration(math.Float64frombits(atomic.LoadUint64(&rh.latencyEWMA)) * float64(time.Second))
+}
+
+// ObserveTimeToFirstByte records the time from accepting a client until its connection to the router host was ready
+func (rh *RouterHost) ObserveTimeToFirstByte(d time.Duration) {
+	if rh.latency != nil {
+		rh.latency.TimeToFirstByte.Observe(d)
+	}
+}
+
+// ObserveLifetime records the time from accepting a client until its connection was closed
+func (rh *RouterHost) ObserveLifetime(d time.Duration) {
+	if rh.latency != nil {
+		rh.latency.Lifetime.Observe(d)
+	}
+}
+
+// LatencyStats returns a copy of the timing histograms of the router host
+func (rh *RouterHost) LatencyStats() LatencyStats {
+	if rh.latency == nil {
+		return NewLatency().Stats()
+	}
+	return rh.latency.Stats()
+}
+
+func (rh *RouterHost) ResetTotalConnections() {
+	atomic.StoreInt64(&rh.totalConnections, 0)
+}
+
+// ResetRefusedConnections resets the counters of refused and rejected connections
+func (rh *RouterHost) ResetRefusedConnections() {
+	atomic.StoreUint64(&rh.refusedConnections, 0)
+	atomic.StoreUint64(&rh.rejectedConnections, 0)
 }
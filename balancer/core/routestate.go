@@ -0,0 +1,104 @@
+package core
+
+import "sync/atomic"
+
+// RouteState holds the live counters of a route on one cluster.
+// It is shared between routing table snapshots and only accessed atomically.
+type RouteState struct {
+	activeConnections   int64
+	totalConnections    uint64
+	refusedConnections  uint64
+	rejectedConnections uint64
+	deniedConnections   uint64
+	bytesIn             uint64
+	bytesOut            uint64
+}
+
+func (rs *RouteState) ActiveConnections() int64 {
+	return atomic.LoadInt64(&rs.activeConnections)
+}
+
+// AtLimit returns true if the route has no free connection slot left
+func (rs *RouteState) AtLimit(maxConnections int) bool {
+	return maxConnections > 0 && rs.ActiveConnections() >= int64(maxConnections)
+}
+
+// TryAcquire reserves a connection slot if the route is below maxConnections. 0 means no limit
+func (rs *RouteState) TryAcquire(maxConnections int) bool {
+	return tryAcquire(&rs.activeConnections, maxConnections)
+}
+
+func (rs *RouteState) Release() {
+	atomic.AddInt64(&rs.activeConnections, -1)
+}
+
+func (rs *RouteState) TotalConnections() uint64 {
+	return atomic.LoadUint64(&rs.totalConnections)
+}
+
+func (rs *RouteState) IncrementConnection() {
+	atomic.AddUint64(&rs.totalConnections, 1)
+}
+
+func (rs *RouteState) RefusedConnections() uint64 {
+	return atomic.LoadUint64(&rs.refusedConnections)
+}
+
+func (rs *RouteState) IncrementRefused() {
+	atomic.AddUint64(&rs.refusedConnections, 1)
+}
+
+func (rs *RouteState) RejectedConnections() uint64 {
+	return atomic.LoadUint64(&rs.rejectedConnections)
+}
+
+func (rs *RouteState) IncrementRejected() {
+	atomic.AddUint64(&rs.rejectedConnections, 1)
+}
+
+func (rs *RouteState) DeniedConnections() uint64 {
+	return atomic.LoadUint64(&rs.deniedConnections)
+}
+
+func (rs *RouteState) IncrementDenied() {
+	atomic.AddUint64(&rs.deniedConnections, 1)
+}
+
+// AddBytesIn counts bytes sent by clients of the route
+func (rs *RouteState) AddBytesIn(n int) {
+	atomic.AddUint64(&rs.bytesIn, uint64(n))
+}
+
+// AddBytesOut counts bytes sent to clients of the route
+func (rs *RouteState) AddBytesOut(n int) {
+	atomic.AddUint64(&rs.bytesOut, uint64(n))
+}
+
+func (rs *RouteState) BytesIn() uint64 {
+	return atomic.LoadUint64(&rs.bytesIn)
+}
+
+func (rs *RouteState) BytesOut() uint64 {
+	return atomic.LoadUint64(&rs.bytesOut)
+}
+
+// ResetConnections resets the counters of total, refused, rejected and denied connections
+func (rs *RouteState) ResetConnections() {
+	atomic.StoreUint64(&rs.totalConnections, 0)
+	atomic.StoreUint64(&rs.refusedConnections, 0)
+	atomic.StoreUint64(&rs.rejectedConnections, 0)
+	atomic.StoreUint64(&rs.deniedConnections, 0)
+}
+
+// tryAcquire increments counter if it is below max. A max of 0 means no limit
+func tryAcquire(counter *int64, max int) bool {
+	for {
+		current := atomic.LoadInt64(counter)
+		if max > 0 && current >= int64(max) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(counter, current, current+1) {
+			return true
+		}
+	}
+}
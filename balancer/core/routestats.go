@@ -0,0 +1,77 @@
+package core
+
+// RouteStats are the statistics of a route hostname on every cluster that serves it
+type RouteStats struct {
+	Hostname string                       `json:"hostname"`
+	Clusters map[string]RouteClusterStats `json:"clusters"`
+}
+
+// RouteClusterStats are the counters of a route on one cluster. The shares compare the
+// configured weight of the cluster with the connections it actually got
+type RouteClusterStats struct {
+	Weight              int     `json:"weight"`
+	WeightShare         float64 `json:"weightShare"`
+	ConnectionShare     float64 `json:"connectionShare"`
+	TotalConnections    uint64  `json:"totalConnections"`
+	ActiveConnections   int64   `json:"activeConnections"`
+	RefusedConnections  uint64  `json:"refusedConnections"`
+	RejectedConnections uint64  `json:"rejectedConnections"`
+	DeniedConnections   uint64  `json:"deniedConnections"`
+	BytesIn             uint64  `json:"bytesIn"`
+	BytesOut            uint64  `json:"bytesOut"`
+}
+
+// RouteStats returns the statistics of all routes by hostname
+func (t *RoutingTable) RouteStats() map[string]RouteStats {
+	stats := map[string]RouteStats{}
+
+	for _, cl := range t.Clusters {
+		for _, r := range cl.Routes {
+			hostname := NormalizeHostname(r.URL)
+			rs, ok := cl.RouteStates[hostname]
+			if !ok {
+				continue
+			}
+
+			s, ok := stats[hostname]
+			if !ok {
+				s = RouteStats{Hostname: hostname, Clusters: map[string]RouteClusterStats{}}
+				stats[hostname] = s
+			}
+			s.Clusters[cl.Key] = RouteClusterStats{
+				Weight:              r.Weight,
+				TotalConnections:    rs.TotalConnections(),
+				ActiveConnections:   rs.ActiveConnections(),
+				RefusedConnections:  rs.RefusedConnections(),
+				RejectedConnections: rs.RejectedConnections(),
+				DeniedConnections:   rs.DeniedConnections(),
+				BytesIn:             rs.BytesIn(),
+				BytesOut:            rs.BytesOut(),
+			}
+		}
+	}
+
+	for _, s := range stats {
+		s.setShares()
+	}
+
+	return stats
+}
+
+func (s RouteStats) setShares() {
+	totalWeight, totalConnections := 0, uint64(0)
+	for _, c := range s.Clusters {
+		totalWeight += c.Weight
+		totalConnections += c.TotalConnections
+	}
+
+	for key, c := range s.Clusters {
+		if totalWeight > 0 {
+			c.WeightShare = float64(c.Weight) / float64(totalWeight)
+		}
+		if totalConnections > 0 {
+			c.ConnectionShare = float64(c.TotalConnections) / float64(totalConnections)
+		}
+		s.Clusters[key] = c
+	}
+}
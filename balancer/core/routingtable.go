@@ -0,0 +1,30 @@
+package core
+
+// RoutingTable is an immutable snapshot of all clusters with their routes and router hosts.
+// The scheduler publishes a new one on every change, so elections can read it without locking.
+// Router hosts are shared between snapshots, their state is only changed atomically.
+type RoutingTable struct {
+	Clusters map[string]*Cluster
+}
+
+func NewRoutingTable(clusters map[string]*Cluster) *RoutingTable {
+	t := &RoutingTable{
+		Clusters: make(map[string]*Cluster, len(clusters)),
+	}
+
+	for k, cl := range clusters {
+		t.Clusters[k] = cl.Copy()
+	}
+
+	return t
+}
+
+// TerminatesTLS returns true if a route for hostname on any cluster wants the balancer to terminate TLS
+func (t *RoutingTable) TerminatesTLS(hostname string) bool {
+	for _, cl := range t.Clusters {
+		if r, _, ok := cl.Route(hostname); ok && r.TLSTermination != TLSPassthrough {
+			return true
+		}
+	}
+	return false
+}
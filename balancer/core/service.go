@@ -0,0 +1,37 @@
+package core
+
+// Service is a tcp service of a cluster that is balanced on its own listener of the balancer,
+// like a database behind a NodePort. Its backends are checked and limited like router hosts.
+type Service struct {
+	// Weight is the share of the connections to the service that goes to this cluster
+	Weight   int                   `json:"weight"`
+	Backends map[string]RouterHost `json:"backends"`
+}
+
+// ClusterService holds the backends of a service on a cluster
+type ClusterService struct {
+	Name     string
+	Weight   int
+	Backends map[string]*RouterHost
+}
+
+// Copy returns a copy of the service that does not share its backend map with the original
+func (s *ClusterService) Copy() *ClusterService {
+	cp := &ClusterService{
+		Name:     s.Name,
+		Weight:   s.Weight,
+		Backends: make(map[string]*RouterHost, len(s.Backends)),
+	}
+
+	for k, be := range s.Backends {
+		cp.Backends[k] = be
+	}
+
+	return cp
+}
+
+func (s *ClusterService) Stop() {
+	for _, be := range s.Backends {
+		be.Stop()
+	}
+}
@@ -0,0 +1,138 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/core"
+	"github.com/sirupsen/logrus"
+)
+
+// Types of the events
+const (
+	ClusterAdded        = "cluster_added"
+	ClusterUpdated      = "cluster_updated"
+	ClusterRemoved      = "cluster_removed"
+	RouterHostAdded     = "router_host_added"
+	RouterHostRemoved   = "router_host_removed"
+	RouterHostHealthy   = "router_host_healthy"
+	RouterHostUnhealthy = "router_host_unhealthy"
+	RouteWeightChanged  = "route_weight_changed"
+	RouteDrained        = "route_drained"
+	RouteUndrained      = "route_undrained"
+	Stats               = "stats"
+)
+
+// Types are all event types
+var Types = []string{
+	ClusterAdded, ClusterUpdated, ClusterRemoved, RouterHostAdded, RouterHostRemoved,
+	RouterHostHealthy, RouterHostUnhealthy, RouteWeightChanged, RouteDrained, RouteUndrained, Stats,
+}
+
+// ValidType returns true if t is one of the Types
+func ValidType(t string) bool {
+	for _, known := range Types {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is a state transition of the balancer or a stats snapshot. Only the fields
+// of the type are set
+type Event struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Cluster    string    `json:"cluster,omitempty"`
+	RouterHost string    `json:"routerHost,omitempty"`
+	HostIP     string    `json:"hostIP,omitempty"`
+
+	// Route, OldWeight and Weight are set on RouteWeightChanged, RouteDrained and RouteUndrained.
+	// The weights are always sent, as 0 is the weight of a drained route
+	Route     string `json:"route,omitempty"`
+	OldWeight int    `json:"oldWeight"`
+	Weight    int    `json:"weight"`
+
+	// Stats is the sample of the router hosts and routes on Stats
+	Stats *core.HistorySample `json:"stats,omitempty"`
+}
+
+// subscriberQueueSize are the events queued per subscriber. A subscriber that falls
+// further behind is removed
+const subscriberQueueSize = 64
+
+// Subscription receives the events of its types on C until it is unsubscribed.
+// C is closed if the subscriber is too slow
+type Subscription struct {
+	C     <-chan Event
+	c     chan Event
+	types map[string]bool
+}
+
+func (s *Subscription) wants(t string) bool {
+	return len(s.types) == 0 || s.types[t]
+}
+
+// Bus sends the published events to all subscribers. A nil Bus discards them
+type Bus struct {
+	subscribers map[*Subscription]bool
+	mux         sync.Mutex
+}
+
+func NewBus() *Bus {
+	return &Bus{subscribers: map[*Subscription]bool{}}
+}
+
+// Subscribe returns a subscription to the events of types, or all events if types is empty
+func (b *Bus) Subscribe(types []string) *Subscription {
+	c := make(chan Event, subscriberQueueSize)
+	s := &Subscription{C: c, c: c, types: map[string]bool{}}
+	for _, t := range types {
+		s.types[t] = true
+	}
+
+	b.mux.Lock()
+	b.subscribers[s] = true
+	b.mux.Unlock()
+	return s
+}
+
+func (b *Bus) Unsubscribe(s *Subscription) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.remove(s)
+}
+
+// remove has to be called with the lock held
+func (b *Bus) remove(s *Subscription) {
+	if _, ok := b.subscribers[s]; ok {
+		delete(b.subscribers, s)
+		close(s.c)
+	}
+}
+
+// Publish sends the event to the subscribers of its type without waiting for them
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	for s := range b.subscribers {
+		if !s.wants(e.Type) {
+			continue
+		}
+
+		select {
+		case s.c <- e:
+		default:
+			logrus.Warn("Event subscriber is too slow, removing it")
+			b.remove(s)
+		}
+	}
+}
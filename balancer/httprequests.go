@@ -0,0 +1,327 @@
+package balancer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/accesslog"
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/core"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxIdleConnsPerRouterHost = 32
+	idleConnTimeout           = 90 * time.Second
+)
+
+type requestContextKey int
+
+const (
+	clientConnKey requestContextKey = iota
+	proxyProtocolKey
+	serverNameKey
+)
+
+var errListenerClosed = errors.New("listener closed")
+
+// connListener hands connections that were accepted by the balancer over to a http.Server
+type connListener struct {
+	addr   net.Addr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// clientConn is a client connection served by the http server
+type clientConn struct {
+	*core.ReleaseConn
+
+	// terminated is true if the balancer terminated TLS of the client
+	terminated bool
+}
+
+// requestBalancer balances every http request on its own. Connections to the
+// router hosts are kept in a pool per router host and reused between clients.
+type requestBalancer struct {
+	b        *Balancer
+	listener *connListener
+	server   *http.Server
+
+	pooled *http.Transport
+
+	// The PROXY protocol header is only valid for one client and re-encrypted connections
+	// carry the SNI of the client, those connections are not reused
+	unpooled *http.Transport
+}
+
+func newRequestBalancer(b *Balancer, addr net.Addr) *requestBalancer {
+	rb := &requestBalancer{
+		b:        b,
+		listener: newConnListener(addr),
+	}
+
+	dialer := &net.Dialer{Timeout: b.cfg.RouterHostTimeout}
+	rb.pooled = &http.Transport{
+		DialContext:         dialer.DialContext,
+		MaxIdleConnsPerHost: maxIdleConnsPerRouterHost,
+		IdleConnTimeout:     idleConnTimeout,
+	}
+	rb.unpooled = &http.Transport{
+		DialContext:       rb.dialWithProxyProtocol(dialer),
+		DialTLSContext:    rb.dialTLS(dialer),
+		DisableKeepAlives: true,
+	}
+
+	rb.server = &http.Server{
+		Handler:     http.HandlerFunc(rb.serveHTTP),
+		IdleTimeout: idleConnTimeout,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, clientConnKey, c)
+		},
+	}
+
+	go func() {
+		if err := rb.server.Serve(rb.listener); err != nil && err != errListenerClosed {
+			logrus.Error("Http request balancer stopped: ", err)
+		}
+	}()
+
+	return rb
+}
+
+// serveConnection lets the http server handle the client connection and returns when it is closed
+func (rb *requestBalancer) serveConnection(ctx *core.Context) {
+	closed := make(chan struct{})
+	var once sync.Once
+	conn := &clientConn{
+		ReleaseConn: core.NewReleaseConn(ctx.Conn, func() {
+			once.Do(func() { close(closed) })
+		}),
+		terminated: ctx.Terminated,
+	}
+
+	select {
+	case rb.listener.conns <- conn:
+		<-closed
+	case <-rb.listener.closed:
+		conn.Close()
+	}
+}
+
+func (rb *requestBalancer) Close() {
+	rb.listener.Close()
+	rb.server.Close()
+	rb.pooled.CloseIdleConnections()
+}
+
+func (rb *requestBalancer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	clientConn := r.Context().Value(clientConnKey).(*clientConn)
+
+	// Every request gets its own router host
+	ctx := core.Context{
+		Hostname:   r.Host,
+		HTTPS:      clientConn.terminated,
+		Terminated: clientConn.terminated,
+		Accepted:   time.Now(),
+		Client:     core.AddrIP(clientConn.RemoteAddr()),
+	}
+
+	// Every request gets its own access log entry
+	entry := &accesslog.Entry{
+		Time:        ctx.Accepted,
+		Client:      clientConn.RemoteAddr().String(),
+		Listener:    "http",
+		Hostname:    r.Host,
+		CloseReason: accesslog.CloseCompleted,
+	}
+	if clientConn.terminated {
+		entry.Listener = "https"
+	}
+	defer rb.b.accessLog.Log(entry)
+
+	election, err := rb.b.Scheduler.ElectRouterHostRequest(ctx)
+	if err != nil {
+		logrus.Error(err, ". Refusing request from: ", clientConn.RemoteAddr())
+		entry.CloseReason = electionErrorReason(err)
+		if entry.CloseReason == accesslog.CloseDenied {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		} else {
+			http.Error(w, "No router host available", http.StatusServiceUnavailable)
+		}
+		return
+	}
+	defer rb.b.Scheduler.UpdateRouterStats(election, DecrementConnection)
+	entry.SetElection(election)
+
+	routerHost := election.RouterHost
+	port, reencrypt := routerHostPort(&ctx, election)
+	target := net.JoinHostPort(routerHost.HostIP, strconv.Itoa(port))
+	logrus.Debugf("Selected target router host: %v in port %v for request", routerHost.Name, port)
+
+	scheme, proto := "http", "http"
+	if clientConn.terminated {
+		proto = "https"
+	}
+
+	transport := rb.pooled
+	if version := rb.b.proxyProtocolVersion(election); version == core.ProxyProtocolV1 || version == core.ProxyProtocolV2 {
+		transport = rb.unpooled
+		r = r.WithContext(context.WithValue(r.Context(), proxyProtocolKey, version))
+	}
+	if reencrypt {
+		scheme = "https"
+		transport = rb.unpooled
+		r = r.WithContext(context.WithValue(r.Context(), serverNameKey, requestHostname(r)))
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Transport: transport,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = scheme
+			pr.Out.URL.Host = target
+			pr.Out.Host = pr.In.Host
+
+			// Pass the forwarding headers of the client on unchanged, unless we add our own
+			for _, h := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "Forwarded"} {
+				if v, ok := pr.In.Header[h]; ok {
+					pr.Out.Header[h] = v
+				}
+			}
+			if rb.b.cfg.ForwardedHeaders != core.ForwardedHeadersNone && len(rb.b.cfg.ForwardedHeaders) > 0 {
+				info := core.ForwardedInfo{
+					ClientAddr: clientConn.RemoteAddr(),
+					LocalAddr:  clientConn.LocalAddr(),
+					Proto:      proto,
+				}
+				info.SetHeaders(pr.Out.Header, pr.In.Host)
+			}
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			// The body of an upgraded connection has to stay writable for the proxy
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				resp.Body = &countingBody{ReadCloser: resp.Body, count: func(n int) {
+					election.AddBytesOut(n)
+					atomic.AddUint64(&entry.BytesOut, uint64(n))
+				}}
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			entry.CloseReason = accesslog.CloseProxyError
+			if opErr, ok := err.(*net.OpError); ok && opErr.Op == "dial" {
+				routerHost.ObserveDialError(0, rb.b.cfg.RouterHostTimeout)
+				rb.b.Scheduler.UpdateRouterStats(election, IncrementRefused)
+				entry.CloseReason = accesslog.CloseDialError
+			}
+			logrus.Errorf("Error proxying request to router host: %v. Err: %v", routerHost.Name, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &countingBody{ReadCloser: r.Body, count: func(n int) {
+			election.AddBytesIn(n)
+			atomic.AddUint64(&entry.BytesIn, uint64(n))
+		}}
+	}
+
+	rb.b.Scheduler.UpdateRouterStats(election, IncrementConnection)
+	proxy.ServeHTTP(w, r)
+}
+
+// countingBody counts the bytes of a request or response body that are read by the proxy
+type countingBody struct {
+	io.ReadCloser
+	count core.CountFunc
+}
+
+func (cb *countingBody) Read(p []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(p)
+	if n > 0 {
+		cb.count(n)
+	}
+	return n, err
+}
+
+// dialWithProxyProtocol connects to the router host and sends the PROXY protocol header of the requesting client
+func (rb *requestBalancer) dialWithProxyProtocol(dialer *net.Dialer) func(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		clientConn := ctx.Value(clientConnKey).(*clientConn)
+		version, _ := ctx.Value(proxyProtocolKey).(string)
+		if err := core.WriteProxyProtocolHeader(conn, version, clientConn.RemoteAddr(), clientConn.LocalAddr()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return conn, nil
+	}
+}
+
+// dialTLS connects to the router host like dialWithProxyProtocol and encrypts the
+// connection again with the hostname of the request as SNI
+func (rb *requestBalancer) dialTLS(dialer *net.Dialer) func(ctx context.Context, network string, addr string) (net.Conn, error) {
+	dial := rb.dialWithProxyProtocol(dialer)
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		serverName, _ := ctx.Value(serverNameKey).(string)
+		tlsConn := tls.Client(conn, rb.b.reencryptConfig(serverName))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return tlsConn, nil
+	}
+}
+
+// requestHostname returns the host of the request without port
+func requestHostname(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		return core.NormalizeHostname(host)
+	}
+	return core.NormalizeHostname(r.Host)
+}
@@ -0,0 +1,73 @@
+package balancer
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Modes for plain http connections on the https listener
+const (
+	// PlainHTTPRedirect answers the first request with a redirect to https
+	PlainHTTPRedirect = "redirect"
+	// PlainHTTPRoute balances the connection by its Host header like on the http listener
+	PlainHTTPRoute = "route"
+)
+
+// ValidPlainHTTPMode returns true if mode is a known mode for plain http on the https listener
+func ValidPlainHTTPMode(mode string) bool {
+	return mode == PlainHTTPRedirect || mode == PlainHTTPRoute
+}
+
+// unrecognizedNameAlert is a fatal TLS alert for clients without SNI hostname
+var unrecognizedNameAlert = []byte{21, 3, 1, 0, 2, 2, 112}
+
+var badRequestResponse = []byte("HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+
+// handlePlainHTTPOnHTTPS handles a client that speaks plain http to the https listener
+func (b *Balancer) handlePlainHTTPOnHTTPS(conn net.Conn, accepted time.Time) {
+	b.Scheduler.StatsHandler.IncrementPlainHTTPOnHTTPS()
+
+	if b.cfg.PlainHTTPOnHTTPS == PlainHTTPRoute {
+		b.wrapHttpConnection(conn, accepted)
+		return
+	}
+
+	b.redirectToHTTPS(conn)
+}
+
+// redirectToHTTPS answers the first request of the client with a redirect to the same url on https
+func (b *Balancer) redirectToHTTPS(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		logrus.Debugf("Failed to read plain http request on https listener from %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	if len(req.Host) == 0 {
+		conn.Write(badRequestResponse)
+		return
+	}
+
+	// The Host is kept as sent. Without a port the client reached the balancer on the default
+	// ports, like through NAT or a load balancer in front, so the listener port is not reachable
+	logrus.Debugf("Redirecting plain http request for '%v' from %v to https", req.Host, conn.RemoteAddr())
+	fmt.Fprintf(conn, "HTTP/1.1 308 Permanent Redirect\r\nLocation: https://%s%s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+		req.Host, req.URL.RequestURI())
+}
+
+// rejectMissingSNI closes a TLS connection without SNI hostname with an alert
+func (b *Balancer) rejectMissingSNI(conn net.Conn) {
+	logrus.Debugf("Closing TLS connection without SNI hostname from %v", conn.RemoteAddr())
+
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write(unrecognizedNameAlert)
+	conn.Close()
+}
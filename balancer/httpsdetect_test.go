@@ -0,0 +1,38 @@
+package balancer
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"app.example.com", "https://app.example.com/path?q=1"},
+		{"app.example.com:8443", "https://app.example.com:8443/path?q=1"},
+		{"[::1]", "https://[::1]/path?q=1"},
+		{"[::1]:8443", "https://[::1]:8443/path?q=1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go (&Balancer{}).redirectToHTTPS(server)
+
+			fmt.Fprintf(client, "GET /path?q=1 HTTP/1.1\r\nHost: %v\r\n\r\n", tt.host)
+			resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusPermanentRedirect || resp.Header.Get("Location") != tt.want {
+				t.Fatalf("got %v to %v", resp.StatusCode, resp.Header.Get("Location"))
+			}
+		})
+	}
+}
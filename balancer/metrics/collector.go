@@ -0,0 +1,173 @@
+package metrics
+
+import (
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/core"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	activeConnectionsDesc = prometheus.NewDesc(namespace+"_router_host_active_connections",
+		"Active connections of the router host.", []string{"cluster", "host"}, nil)
+	healthyDesc = prometheus.NewDesc(namespace+"_router_host_healthy",
+		"1 if the last health check of the router host succeeded.", []string{"cluster", "host"}, nil)
+	maxConnectionsDesc = prometheus.NewDesc(namespace+"_router_host_max_connections",
+		"Connection limit of the router host, 0 means no limit.", []string{"cluster", "host"}, nil)
+	latencyEWMADesc = prometheus.NewDesc(namespace+"_router_host_latency_ewma_seconds",
+		"Moving average of the connect latency of the router host that is used by the ewma strategy.", []string{"cluster", "host"}, nil)
+	routesDesc = prometheus.NewDesc(namespace+"_cluster_routes",
+		"Routes of the cluster.", []string{"cluster"}, nil)
+	routeActiveConnectionsDesc = prometheus.NewDesc(namespace+"_route_active_connections",
+		"Active connections of the route on the cluster.", []string{"cluster", "route"}, nil)
+	backendActiveConnectionsDesc = prometheus.NewDesc(namespace+"_service_backend_active_connections",
+		"Active connections or udp sessions of the service backend.", []string{"cluster", "service", "host"}, nil)
+	backendHealthyDesc = prometheus.NewDesc(namespace+"_service_backend_healthy",
+		"1 if the last health check of the service backend succeeded.", []string{"cluster", "service", "host"}, nil)
+	bytesDesc = prometheus.NewDesc(namespace+"_router_host_bytes_total",
+		"Bytes proxied by the router host, in from the clients or out to the clients.", []string{"cluster", "host", "direction"}, nil)
+	routeBytesDesc = prometheus.NewDesc(namespace+"_route_bytes_total",
+		"Bytes proxied for the route on the cluster.", []string{"cluster", "route", "direction"}, nil)
+	backendBytesDesc = prometheus.NewDesc(namespace+"_service_backend_bytes_total",
+		"Bytes proxied by the service backend.", []string{"cluster", "service", "host", "direction"}, nil)
+)
+
+// latencyDescs describe the timing histograms of router hosts or service backends
+type latencyDescs struct {
+	dial            *prometheus.Desc
+	timeToFirstByte *prometheus.Desc
+	lifetime        *prometheus.Desc
+}
+
+func newLatencyDescs(prefix string, subject string, labels []string) latencyDescs {
+	return latencyDescs{
+		dial: prometheus.NewDesc(prefix+"_dial_duration_seconds",
+			"Time to connect to the "+subject+".", labels, nil),
+		timeToFirstByte: prometheus.NewDesc(prefix+"_time_to_first_byte_seconds",
+			"Time from accepting the client, including the hostname sniffing, until the connection is ready to forward the first byte.", labels, nil),
+		lifetime: prometheus.NewDesc(prefix+"_connection_lifetime_seconds",
+			"Time from accepting the client until the connection is closed.", labels, nil),
+	}
+}
+
+func (d latencyDescs) describe(ch chan<- *prometheus.Desc) {
+	ch <- d.dial
+	ch <- d.timeToFirstByte
+	ch <- d.lifetime
+}
+
+func (d latencyDescs) collect(ch chan<- prometheus.Metric, l core.LatencyStats, labels ...string) {
+	ch <- constHistogram(d.dial, l.Dial, labels)
+	ch <- constHistogram(d.timeToFirstByte, l.TimeToFirstByte, labels)
+	ch <- constHistogram(d.lifetime, l.Lifetime, labels)
+}
+
+var (
+	latency        = newLatencyDescs(namespace+"_router_host", "router host", []string{"cluster", "host"})
+	backendLatency = newLatencyDescs(namespace+"_service_backend", "service backend", []string{"cluster", "service", "host"})
+)
+
+// Directions of the byte counters
+const (
+	directionIn  = "in"
+	directionOut = "out"
+)
+
+// Collector reports the current state of the clusters from the routing table
+type Collector struct {
+	routingTable func() *core.RoutingTable
+}
+
+func NewCollector(routingTable func() *core.RoutingTable) *Collector {
+	return &Collector{
+		routingTable: routingTable,
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeConnectionsDesc
+	ch <- healthyDesc
+	ch <- maxConnectionsDesc
+	ch <- latencyEWMADesc
+	ch <- routesDesc
+	ch <- routeActiveConnectionsDesc
+	ch <- backendActiveConnectionsDesc
+	ch <- backendHealthyDesc
+	ch <- bytesDesc
+	ch <- routeBytesDesc
+	ch <- backendBytesDesc
+	latency.describe(ch)
+	backendLatency.describe(ch)
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, cl := range c.routingTable().Clusters {
+		for _, rh := range cl.RouterHosts {
+			ch <- prometheus.MustNewConstMetric(activeConnectionsDesc, prometheus.GaugeValue,
+				float64(rh.ActiveConnections()), cl.Key, rh.Name)
+			ch <- prometheus.MustNewConstMetric(healthyDesc, prometheus.GaugeValue,
+				boolValue(rh.Healthy()), cl.Key, rh.Name)
+			ch <- prometheus.MustNewConstMetric(maxConnectionsDesc, prometheus.GaugeValue,
+				float64(rh.Limit()), cl.Key, rh.Name)
+			ch <- prometheus.MustNewConstMetric(latencyEWMADesc, prometheus.GaugeValue,
+				rh.LatencyEWMA().Seconds(), cl.Key, rh.Name)
+			ch <- prometheus.MustNewConstMetric(bytesDesc, prometheus.CounterValue,
+				float64(rh.BytesIn()), cl.Key, rh.Name, directionIn)
+			ch <- prometheus.MustNewConstMetric(bytesDesc, prometheus.CounterValue,
+				float64(rh.BytesOut()), cl.Key, rh.Name, directionOut)
+			latency.collect(ch, rh.LatencyStats(), cl.Key, rh.Name)
+		}
+
+		ch <- prometheus.MustNewConstMetric(routesDesc, prometheus.GaugeValue, float64(len(cl.Routes)), cl.Key)
+		for route, state := range cl.RouteStates {
+			ch <- prometheus.MustNewConstMetric(routeActiveConnectionsDesc, prometheus.GaugeValue,
+				float64(state.ActiveConnections()), cl.Key, route)
+			ch <- prometheus.MustNewConstMetric(routeBytesDesc, prometheus.CounterValue,
+				float64(state.BytesIn()), cl.Key, route, directionIn)
+			ch <- prometheus.MustNewConstMetric(routeBytesDesc, prometheus.CounterValue,
+				float64(state.BytesOut()), cl.Key, route, directionOut)
+		}
+
+		for _, svc := range cl.Services {
+			for _, be := range svc.Backends {
+				ch <- prometheus.MustNewConstMetric(backendActiveConnectionsDesc, prometheus.GaugeValue,
+					float64(be.ActiveConnections()), cl.Key, svc.Name, be.Name)
+				ch <- prometheus.MustNewConstMetric(backendHealthyDesc, prometheus.GaugeValue,
+					boolValue(be.Healthy()), cl.Key, svc.Name, be.Name)
+				ch <- prometheus.MustNewConstMetric(backendBytesDesc, prometheus.CounterValue,
+					float64(be.BytesIn()), cl.Key, svc.Name, be.Name, directionIn)
+				ch <- prometheus.MustNewConstMetric(backendBytesDesc, prometheus.CounterValue,
+					float64(be.BytesOut()), cl.Key, svc.Name, be.Name, directionOut)
+				backendLatency.collect(ch, be.LatencyStats(), cl.Key, svc.Name, be.Name)
+			}
+		}
+	}
+}
+
+// Register registers the counters and a collector for the routing table with the default registry
+func Register(routingTable func() *core.RoutingTable) {
+	prometheus.MustRegister(
+		Connections,
+		RefusedConnections,
+		RejectedConnections,
+		ElectionErrors,
+		HealthCheckDuration,
+		NewCollector(routingTable),
+	)
+}
+
+// constHistogram converts the per bucket counts of h to the cumulative buckets of prometheus
+func constHistogram(desc *prometheus.Desc, h core.HistogramStats, labels []string) prometheus.Metric {
+	buckets := make(map[float64]uint64, len(h.Bounds))
+	var cumulative uint64
+	for i, bound := range h.Bounds {
+		cumulative += h.Counts[i]
+		buckets[bound] = cumulative
+	}
+	return prometheus.MustNewConstHistogram(desc, h.Count, h.Sum, buckets, labels...)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
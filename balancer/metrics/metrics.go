@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "smartlb"
+
+// Reasons of failed elections
+const (
+	ElectionErrorLimit       = "limit"
+	ElectionErrorNoRouteHost = "no_router_host"
+	ElectionErrorDenied      = "denied"
+)
+
+// Counters of events. The counters of the router hosts are reset for the UI, so they can't be used here
+var (
+	Connections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "connections_total",
+		Help:      "Connections to router hosts and service backends.",
+	}, []string{"cluster", "host", "route"})
+
+	RefusedConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "refused_connections_total",
+		Help:      "Connections that a router host or service backend refused.",
+	}, []string{"cluster", "host"})
+
+	RejectedConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rejected_connections_total",
+		Help:      "Connections that were rejected because a router host was at its connection limit.",
+	}, []string{"cluster", "host"})
+
+	ElectionErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "election_errors_total",
+		Help:      "Connections for which no router host could be elected.",
+	}, []string{"reason"})
+
+	HealthCheckDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "health_check_duration_seconds",
+		Help:      "Duration of the health checks of router hosts and service backends.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"cluster", "host"})
+)
@@ -0,0 +1,80 @@
+package balancer
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/balancing"
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/core"
+)
+
+var errQueueFull = errors.New("connection queue is full")
+
+// connectionQueue lets connections wait for a free slot when all
+// possible router hosts or routes are at their connection limit
+type connectionQueue struct {
+	waiting int64
+	size    int64
+	timeout time.Duration
+
+	// released is closed and replaced every time a connection slot is freed
+	released chan struct{}
+	mux      sync.Mutex
+}
+
+func newConnectionQueue(size int, timeout time.Duration) *connectionQueue {
+	return &connectionQueue{
+		size:     int64(size),
+		timeout:  timeout,
+		released: make(chan struct{}),
+	}
+}
+
+func (q *connectionQueue) enabled() bool {
+	return q.size > 0 && q.timeout > 0
+}
+
+// wait retries elect whenever a connection slot is freed until it no longer
+// fails because of connection limits or the queue timeout is reached
+func (q *connectionQueue) wait(elect func() (*core.Election, error)) (*core.Election, error) {
+	if atomic.AddInt64(&q.waiting, 1) > q.size {
+		atomic.AddInt64(&q.waiting, -1)
+		return nil, errQueueFull
+	}
+	defer atomic.AddInt64(&q.waiting, -1)
+
+	timeout := time.NewTimer(q.timeout)
+	defer timeout.Stop()
+
+	for {
+		// Get the channel before electing, so no release in between is missed
+		q.mux.Lock()
+		released := q.released
+		q.mux.Unlock()
+
+		election, err := elect()
+		if _, limited := err.(*balancing.LimitError); !limited {
+			return election, err
+		}
+
+		select {
+		case <-released:
+		case <-timeout.C:
+			return nil, err
+		}
+	}
+}
+
+// notify wakes up all waiting connections
+func (q *connectionQueue) notify() {
+	if atomic.LoadInt64(&q.waiting) == 0 {
+		return
+	}
+
+	q.mux.Lock()
+	close(q.released)
+	q.released = make(chan struct{})
+	q.mux.Unlock()
+}
@@ -0,0 +1,189 @@
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/core"
+)
+
+const cleanupInterval = 1 * time.Minute
+
+var (
+	ErrGlobalRate     = errors.New("global connection rate limit reached")
+	ErrNetworkRate    = errors.New("network connection rate limit reached")
+	ErrClientRate     = errors.New("client connection rate limit reached")
+	ErrClientMaxConns = errors.New("client connection limit reached")
+)
+
+// NetworkRate limits the new connections of all clients in a network together
+type NetworkRate struct {
+	Network *net.IPNet
+	Rate    float64
+}
+
+type Config struct {
+	// New connections per second over all clients. 0 means no limit
+	GlobalRate  float64
+	GlobalBurst int
+
+	// New connections per second of a single client IP. 0 means no limit
+	ClientRate  float64
+	ClientBurst int
+
+	NetworkRates []NetworkRate
+
+	// Concurrent connections of a single client IP. 0 means no limit
+	MaxConnectionsPerClient int
+}
+
+func (c Config) enabled() bool {
+	return c.GlobalRate > 0 || c.ClientRate > 0 || len(c.NetworkRates) > 0 || c.MaxConnectionsPerClient > 0
+}
+
+type client struct {
+	bucket            *tokenBucket
+	activeConnections int
+}
+
+// Limiter decides if a new connection of a client is accepted
+type Limiter struct {
+	cfg         Config
+	global      *tokenBucket
+	networks    []*tokenBucket
+	clients     map[string]*client
+	lastCleanup time.Time
+	mux         sync.Mutex
+
+	// now returns the current time, tests replace the clock
+	now func() time.Time
+}
+
+func NewLimiter(cfg Config) *Limiter {
+	return newLimiter(cfg, time.Now)
+}
+
+func newLimiter(cfg Config, clock func() time.Time) *Limiter {
+	now := clock()
+	l := &Limiter{
+		cfg:         cfg,
+		clients:     map[string]*client{},
+		lastCleanup: now,
+		now:         clock,
+	}
+
+	if cfg.GlobalRate > 0 {
+		l.global = newTokenBucket(cfg.GlobalRate, cfg.GlobalBurst, now)
+	}
+	for _, n := range cfg.NetworkRates {
+		l.networks = append(l.networks, newTokenBucket(n.Rate, 0, now))
+	}
+
+	return l
+}
+
+// Acquire checks all limits for a new connection from addr. If the connection is
+// accepted, release has to be called once it is closed. Calling it again has no effect.
+func (l *Limiter) Acquire(addr net.Addr) (release func(), err error) {
+	if !l.cfg.enabled() {
+		return func() {}, nil
+	}
+
+	ip := core.AddrIP(addr)
+	now := l.now()
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if now.Sub(l.lastCleanup) > cleanupInterval {
+		l.cleanup(now)
+	}
+
+	c, ok := l.clients[ip.String()]
+	if !ok {
+		c = &client{}
+		if l.cfg.ClientRate > 0 {
+			c.bucket = newTokenBucket(l.cfg.ClientRate, l.cfg.ClientBurst, now)
+		}
+	}
+
+	// Check the concurrent connections first, so they don't use up tokens
+	if l.cfg.MaxConnectionsPerClient > 0 && c.activeConnections >= l.cfg.MaxConnectionsPerClient {
+		return nil, ErrClientMaxConns
+	}
+
+	// Every bucket is checked before a token is taken, so a connection that is
+	// rejected by one limit does not use up the tokens of the others
+	var buckets []*tokenBucket
+	if c.bucket != nil {
+		if !c.bucket.available(now) {
+			return nil, ErrClientRate
+		}
+		buckets = append(buckets, c.bucket)
+	}
+	for i, n := range l.cfg.NetworkRates {
+		if ip == nil || !n.Network.Contains(ip) {
+			continue
+		}
+		if !l.networks[i].available(now) {
+			return nil, ErrNetworkRate
+		}
+		buckets = append(buckets, l.networks[i])
+	}
+	if l.global != nil {
+		if !l.global.available(now) {
+			return nil, ErrGlobalRate
+		}
+		buckets = append(buckets, l.global)
+	}
+	for _, b := range buckets {
+		b.take()
+	}
+
+	c.activeConnections++
+	l.clients[ip.String()] = c
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mux.Lock()
+			c.activeConnections--
+			l.mux.Unlock()
+		})
+	}, nil
+}
+
+// cleanup forgets clients without connections whose buckets are full again
+func (l *Limiter) cleanup(now time.Time) {
+	for key, c := range l.clients {
+		if c.activeConnections == 0 && (c.bucket == nil || c.bucket.full(now)) {
+			delete(l.clients, key)
+		}
+	}
+	l.lastCleanup = now
+}
+
+// ParseNetworkRate parses a network rate in the form <cidr>=<connections per second>
+func ParseNetworkRate(s string) (NetworkRate, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return NetworkRate{}, fmt.Errorf("invalid network rate '%v', expected <cidr>=<rate>", s)
+	}
+
+	network, err := core.ParseNetwork(parts[0])
+	if err != nil {
+		return NetworkRate{}, err
+	}
+
+	rate, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || rate <= 0 {
+		return NetworkRate{}, fmt.Errorf("invalid rate in network rate '%v'", s)
+	}
+
+	return NetworkRate{Network: network, Rate: rate}, nil
+}
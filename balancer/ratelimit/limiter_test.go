@@ -0,0 +1,253 @@
+package ratelimit
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// testClock is a clock that only moves when the test advances it
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestLimiter(cfg Config) (*Limiter, *testClock) {
+	clock := &testClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	return newLimiter(cfg, clock.Now), clock
+}
+
+func addr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+}
+
+func mustParseNetworkRate(t *testing.T, s string) NetworkRate {
+	n, err := ParseNetworkRate(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tb := newTokenBucket(2, 4, now)
+	for i := 0; i < 4; i++ {
+		if !tb.available(now) {
+			t.Fatalf("burst exhausted after %v tokens", i)
+		}
+		tb.take()
+	}
+	if tb.available(now) {
+		t.Fatal("token available after the burst")
+	}
+
+	// Half a second refills one token at a rate of two per second
+	now = now.Add(500 * time.Millisecond)
+	if !tb.available(now) {
+		t.Fatal("bucket was not refilled")
+	}
+	tb.take()
+	if tb.available(now) {
+		t.Fatal("bucket was refilled with more than one token")
+	}
+
+	// The bucket never holds more than the burst
+	now = now.Add(time.Hour)
+	if !tb.full(now) || tb.tokens != 4 {
+		t.Fatalf("bucket has %v tokens, expected the burst of 4", tb.tokens)
+	}
+
+	// Without burst the bucket holds the tokens of a second, at least one
+	if b := newTokenBucket(2.5, 0, now).burst; b != 3 {
+		t.Fatalf("default burst %v", b)
+	}
+	if b := newTokenBucket(0.1, 0, now).burst; b != 1 {
+		t.Fatalf("default burst %v", b)
+	}
+}
+
+func TestLimiterRates(t *testing.T) {
+	type step struct {
+		advance time.Duration
+		client  string
+		err     error
+	}
+
+	tests := []struct {
+		name  string
+		cfg   func(t *testing.T) Config
+		steps []step
+	}{
+		{
+			name: "global",
+			cfg:  func(t *testing.T) Config { return Config{GlobalRate: 1, GlobalBurst: 2} },
+			steps: []step{
+				{client: "10.0.0.1"},
+				{client: "10.0.0.2"},
+				{client: "10.0.0.3", err: ErrGlobalRate},
+				{advance: time.Second, client: "10.0.0.3"},
+				{client: "10.0.0.1", err: ErrGlobalRate},
+			},
+		},
+		{
+			name: "client",
+			cfg:  func(t *testing.T) Config { return Config{ClientRate: 1} },
+			steps: []step{
+				{client: "10.0.0.1"},
+				{client: "10.0.0.1", err: ErrClientRate},
+				{client: "10.0.0.2"},
+				{advance: 500 * time.Millisecond, client: "10.0.0.1", err: ErrClientRate},
+				{advance: 500 * time.Millisecond, client: "10.0.0.1"},
+			},
+		},
+		{
+			name: "network",
+			cfg: func(t *testing.T) Config {
+				return Config{NetworkRates: []NetworkRate{mustParseNetworkRate(t, "10.0.0.0/24=1")}}
+			},
+			steps: []step{
+				{client: "10.0.0.1"},
+				{client: "10.0.0.2", err: ErrNetworkRate},
+				{client: "10.0.1.1"},
+				{client: "10.0.1.1"},
+				{advance: time.Second, client: "10.0.0.2"},
+			},
+		},
+		{
+			name: "network of a single ip",
+			cfg: func(t *testing.T) Config {
+				return Config{NetworkRates: []NetworkRate{mustParseNetworkRate(t, "2001:db8::1=2")}}
+			},
+			steps: []step{
+				{client: "2001:db8::1"},
+				{client: "2001:db8::1"},
+				{client: "2001:db8::1", err: ErrNetworkRate},
+				{client: "2001:db8::2"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, clock := newTestLimiter(tt.cfg(t))
+			for i, s := range tt.steps {
+				clock.advance(s.advance)
+				release, err := l.Acquire(addr(s.client))
+				if err != s.err {
+					t.Fatalf("step %v: got %v, expected %v", i, err, s.err)
+				}
+				if err == nil {
+					release()
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterDisabled(t *testing.T) {
+	l, _ := newTestLimiter(Config{})
+	for i := 0; i < 100; i++ {
+		if _, err := l.Acquire(addr("10.0.0.1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLimiterMaxConnectionsPerClient(t *testing.T) {
+	l, _ := newTestLimiter(Config{MaxConnectionsPerClient: 2})
+
+	first, err := l.Acquire(addr("10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Acquire(addr("10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Acquire(addr("10.0.0.1")); err != ErrClientMaxConns {
+		t.Fatalf("got %v, expected %v", err, ErrClientMaxConns)
+	}
+	if _, err := l.Acquire(addr("10.0.0.2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Releasing a connection twice frees only one slot
+	first()
+	first()
+	if _, err := l.Acquire(addr("10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Acquire(addr("10.0.0.1")); err != ErrClientMaxConns {
+		t.Fatalf("got %v, expected %v", err, ErrClientMaxConns)
+	}
+}
+
+// A connection that is rejected by one limit takes no token from the others
+func TestLimiterRejectedKeepsTokens(t *testing.T) {
+	l, _ := newTestLimiter(Config{
+		GlobalRate:              10,
+		GlobalBurst:             1,
+		ClientRate:              1,
+		ClientBurst:             3,
+		NetworkRates:            []NetworkRate{mustParseNetworkRate(t, "10.0.0.0/24=5")},
+		MaxConnectionsPerClient: 1,
+	})
+
+	release, err := l.Acquire(addr("10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, network := l.clients["10.0.0.1"].bucket, l.networks[0]
+	if client.tokens != 2 || network.tokens != 4 || l.global.tokens != 0 {
+		t.Fatalf("tokens after the first connection: client %v, network %v, global %v", client.tokens, network.tokens, l.global.tokens)
+	}
+
+	// Rejected by the concurrent connections of the client
+	if _, err := l.Acquire(addr("10.0.0.1")); err != ErrClientMaxConns {
+		t.Fatalf("got %v, expected %v", err, ErrClientMaxConns)
+	}
+	release()
+
+	// Rejected by the global rate after the client and network buckets were checked
+	if _, err := l.Acquire(addr("10.0.0.1")); err != ErrGlobalRate {
+		t.Fatalf("got %v, expected %v", err, ErrGlobalRate)
+	}
+	if client.tokens != 2 || network.tokens != 4 {
+		t.Fatalf("rejected connection took tokens: client %v, network %v", client.tokens, network.tokens)
+	}
+}
+
+func TestLimiterCleanup(t *testing.T) {
+	l, clock := newTestLimiter(Config{ClientRate: 1, MaxConnectionsPerClient: 1})
+
+	release, err := l.Acquire(addr("10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := l.Acquire(addr("10.0.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done()
+
+	// Only clients without connections and with full buckets are forgotten
+	clock.advance(2 * cleanupInterval)
+	if _, err := l.Acquire(addr("10.0.0.3")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.clients["10.0.0.1"]; !ok {
+		t.Fatal("client with a connection was forgotten")
+	}
+	if _, ok := l.clients["10.0.0.2"]; ok {
+		t.Fatal("idle client was kept")
+	}
+	release()
+}
@@ -0,0 +1,54 @@
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// tokenBucket allows rate events per second with bursts of up to burst events.
+// It is not safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	b := float64(burst)
+	if b < 1 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  b,
+		tokens: b,
+		last:   now,
+	}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(tb.last).Seconds()
+	if elapsed > 0 {
+		tb.tokens = math.Min(tb.burst, tb.tokens+elapsed*tb.rate)
+		tb.last = now
+	}
+}
+
+// available returns true if the bucket has a token left
+func (tb *tokenBucket) available(now time.Time) bool {
+	tb.refill(now)
+	return tb.tokens >= 1
+}
+
+// take removes a token, available has to be checked first
+func (tb *tokenBucket) take() {
+	tb.tokens--
+}
+
+// full returns true if the bucket has refilled completely
+func (tb *tokenBucket) full(now time.Time) bool {
+	tb.refill(now)
+	return tb.tokens >= tb.burst
+}
@@ -4,9 +4,12 @@ import (
 	"time"
 
 	"sync"
+	"sync/atomic"
 
 	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/balancing"
 	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/core"
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/events"
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/metrics"
 	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/stats"
 	"github.com/sirupsen/logrus"
 	"os"
@@ -20,10 +23,24 @@ const (
 	IncrementRefused
 )
 
-type ElectRequest struct {
-	Context  core.Context
-	Response chan core.RouterHost
-	Err      chan error
+type SchedulerConfig struct {
+	// MaxConnectionsPerRouterHost applies to router hosts without their own limit. 0 means no limit
+	MaxConnectionsPerRouterHost int
+
+	// Connections wait up to QueueTimeout in a queue of QueueSize if all
+	// possible router hosts are at their limit. A size of 0 disables the queue
+	QueueSize    int
+	QueueTimeout time.Duration
+
+	// Strategy selects the router host within the cluster chosen by weight. See balancing.Strategy* for the names
+	Strategy string
+
+	// Stats configures the sample interval and retention of the statistics
+	Stats stats.Config
+
+	// UDPServices are the services that are balanced over udp. The health checks use tcp,
+	// so their backends need a HealthCheckPort
+	UDPServices map[string]bool
 }
 
 type SafeClusters struct {
@@ -35,32 +52,48 @@ type SafeClusters struct {
 // - The overall state (clusters, router hosts)
 // - Health-Check-Results
 // - Election of target router hosts
+//
+// Elections run concurrently in the goroutine of each connection. They read the
+// routing table snapshot that is published after every change of the clusters.
 type Scheduler struct {
+	cfg          SchedulerConfig
 	clusters     SafeClusters
+	routingTable atomic.Value
+	queue        *connectionQueue
+	strategy     balancing.Strategy
 	StatsHandler *stats.StatsHandler
 
+	// Events publishes the changes of the clusters and router hosts
+	Events *events.Bus
+
 	healthCheckResults chan core.HealthCheckResult
-	elect              chan ElectRequest
 	ResetStats         chan bool
 	stop               chan bool
 }
 
-func NewScheduler() *Scheduler {
-	return &Scheduler{
+func NewScheduler(cfg SchedulerConfig) *Scheduler {
+	bus := events.NewBus()
+	s := &Scheduler{
+		cfg:          cfg,
 		clusters:     SafeClusters{v: map[string]*core.Cluster{}},
-		StatsHandler: stats.NewHandler(),
+		queue:        newConnectionQueue(cfg.QueueSize, cfg.QueueTimeout),
+		strategy:     balancing.StrategyByName(cfg.Strategy),
+		StatsHandler: stats.NewHandler(cfg.Stats, bus),
+		Events:       bus,
 
 		healthCheckResults: make(chan core.HealthCheckResult),
-		elect:              make(chan ElectRequest),
 		ResetStats:         make(chan bool),
 		stop:               make(chan bool),
 	}
+	s.publishRoutingTable()
+
+	return s
 }
 
 func (s *Scheduler) Start() {
 	s.StatsHandler.Start()
 
-	hostsPushTicket := time.NewTicker(2 * time.Second)
+	hostsPushTicket := time.NewTicker(s.StatsHandler.Interval())
 
 	go func() {
 		for {
@@ -71,11 +104,10 @@ func (s *Scheduler) Start() {
 			case checkResult := <-s.healthCheckResults:
 				s.handleHealthCheckResults(checkResult)
 
-			case electReq := <-s.elect:
-				s.handleRouterHostElect(electReq)
-
 			case <-hostsPushTicket.C:
 				s.StatsHandler.RouterHosts <- s.routerHosts()
+				s.StatsHandler.Traffic <- s.traffic()
+				s.StatsHandler.RouteStats <- s.RoutingTable().RouteStats()
 				s.resetRefusedStats()
 
 			case <-s.stop:
@@ -105,20 +137,56 @@ func (s *Scheduler) AddOrUpdateCluster(clusterKey string, data core.ClusterUpdat
 	} else {
 		s.addCluster(clusterKey, data)
 	}
+	s.publishRoutingTable()
 
 	s.clusters.mux.Unlock()
 }
 
+// RemoveCluster stops the health checks of the cluster and removes it from the elections.
+// Open connections to its router hosts are kept. It returns false if the cluster does not exist
+func (s *Scheduler) RemoveCluster(clusterKey string) bool {
+	s.clusters.mux.Lock()
+	defer s.clusters.mux.Unlock()
+
+	cl, exists := s.clusters.v[clusterKey]
+	if !exists {
+		return false
+	}
+
+	logrus.Infof("Removed cluster: %v", clusterKey)
+	delete(s.clusters.v, clusterKey)
+	s.publishRoutingTable()
+	cl.Stop()
+
+	s.Events.Publish(events.Event{Type: events.ClusterRemoved, Cluster: clusterKey})
+	return true
+}
+
+// RoutingTable returns the current snapshot of all clusters
+func (s *Scheduler) RoutingTable() *core.RoutingTable {
+	return s.routingTable.Load().(*core.RoutingTable)
+}
+
+// publishRoutingTable has to be called with the clusters lock held
+func (s *Scheduler) publishRoutingTable() {
+	s.routingTable.Store(core.NewRoutingTable(s.clusters.v))
+}
+
 func (s *Scheduler) addCluster(clusterKey string, data core.ClusterUpdate) {
 	logrus.Infof("Added cluster: %v", clusterKey)
+	s.Events.Publish(events.Event{Type: events.ClusterAdded, Cluster: clusterKey})
 
 	// Create the new cluster
-	s.clusters.v[clusterKey] = core.NewCluster(clusterKey, data.Routes)
+	cl := core.NewCluster(clusterKey, data.Routes)
+	cl.SetProxyProtocol(data.ProxyProtocol)
+	s.clusters.v[clusterKey] = cl
 
 	// Add all router hosts to it
 	for _, rh := range data.RouterHosts {
 		s.addRouterHost(clusterKey, rh)
 	}
+
+	s.updateServices(cl, data.Services)
 }
 
 func (s *Scheduler) addRouterHost(clusterKey string, rh core.RouterHost) {
@@ -134,18 +202,36 @@ func (s *Scheduler) addRouterHost(clusterKey string, rh core.RouterHost) {
 	}
 
 	newHost := core.NewRouterHost(rh.Name, rh.HostIP, rh.HTTPPort, rh.HTTPSPort, s.healthCheckResults, clusterKey)
+	newHost.MaxConnections = s.routerHostLimit(rh)
+	newHost.ALPN = rh.ALPN
+	newHost.ALPNPorts = rh.ALPNPorts
 	logrus.Infof("New router host was added: %v to scheduler. %v", newHost.Name, newHost.HostIP)
+	s.Events.Publish(events.Event{Type: events.RouterHostAdded, Cluster: clusterKey, RouterHost: newHost.Name, HostIP: newHost.HostIP})
 
 	s.clusters.v[clusterKey].RouterHosts[newHost.Name] = newHost
 }
 
+// routerHostLimit returns the connection limit of the router host or the default limit
+func (s *Scheduler) routerHostLimit(rh core.RouterHost) int {
+	if rh.MaxConnections == 0 {
+		return s.cfg.MaxConnectionsPerRouterHost
+	}
+	return rh.MaxConnections
+}
+
 func (s *Scheduler) updateCluster(ecl *core.Cluster, data core.ClusterUpdate) {
+	s.Events.Publish(events.Event{Type: events.ClusterUpdated, Cluster: ecl.Key})
+
 	// Update routes
-	ecl.Routes = data.Routes
+	s.publishWeightChanges(ecl, data.Routes)
+	ecl.SetRoutes(data.Routes)
+	ecl.SetProxyProtocol(data.ProxyProtocol)
 
-	// Add new routers
+	// Add new routers and update the limits and protocols of the existing ones
 	for _, rh := range data.RouterHosts {
-		if _, exists := ecl.RouterHosts[rh.Name]; !exists {
+		if erh, exists := ecl.RouterHosts[rh.Name]; exists {
+			erh.Update(s.routerHostLimit(rh), rh.ALPN, rh.ALPNPorts)
+		} else {
 			s.addRouterHost(ecl.Key, rh)
 		}
 	}
@@ -154,107 +240,274 @@ func (s *Scheduler) updateCluster(ecl *core.Cluster, data core.ClusterUpdate) {
 	for _, erh := range ecl.RouterHosts {
 		if _, exists := data.RouterHosts[erh.Name]; !exists {
 			logrus.Infof("Router host %v no longer exists, deleting it from cluster", erh.Name)
+			s.Events.Publish(events.Event{Type: events.RouterHostRemoved, Cluster: ecl.Key, RouterHost: erh.Name, HostIP: erh.HostIP})
+			erh.Stop()
 			delete(ecl.RouterHosts, erh.Name)
 		}
 	}
+
+	s.updateServices(ecl, data.Services)
 }
 
-func (s *Scheduler) UpdateRouterStats(clusterKey string, routerHostKey string, action StatsOperationAction) {
-	s.clusters.mux.Lock()
-	defer s.clusters.mux.Unlock()
+// publishWeightChanges publishes the routes of the cluster that get a different weight with the update.
+// Routes that get a weight of 0 are drained on the cluster, routes that had 0 are undrained
+func (s *Scheduler) publishWeightChanges(cl *core.Cluster, routes map[string]core.Route) {
+	for _, r := range routes {
+		old, _, exists := cl.Route(r.URL)
+		if !exists || old.Weight == r.Weight {
+			continue
+		}
 
-	routerHost, ok := s.clusters.v[clusterKey].RouterHosts[routerHostKey]
-	if !ok {
-		logrus.Warn("Trying operation ", action, " on not tracked router host ip: ", routerHostKey)
-		return
+		logrus.Infof("Weight of route %v on %v changed from %v to %v", r.URL, cl.Key, old.Weight, r.Weight)
+		e := events.Event{
+			Type:      events.RouteWeightChanged,
+			Cluster:   cl.Key,
+			Route:     r.URL,
+			OldWeight: old.Weight,
+			Weight:    r.Weight,
+		}
+		s.Events.Publish(e)
+
+		if r.Weight == 0 {
+			logrus.Infof("Route %v is drained on %v", r.URL, cl.Key)
+			e.Type = events.RouteDrained
+			s.Events.Publish(e)
+		} else if old.Weight == 0 {
+			logrus.Infof("Route %v is no longer drained on %v", r.URL, cl.Key)
+			e.Type = events.RouteUndrained
+			s.Events.Publish(e)
+		}
 	}
+}
+
+// updateServices adds, updates and removes the tcp services of the cluster and their backends
+func (s *Scheduler) updateServices(cl *core.Cluster, services map[string]core.Service) {
+	for name, svc := range services {
+		esvc, exists := cl.Services[name]
+		if !exists {
+			logrus.Infof("Added service %v to cluster %v", name, cl.Key)
+			esvc = &core.ClusterService{Name: name, Backends: map[string]*core.RouterHost{}}
+			cl.Services[name] = esvc
+		}
+
+		esvc.Weight = svc.Weight
+		if esvc.Weight <= 0 {
+			esvc.Weight = 1
+		}
+
+		// Add new backends and update the limits of the existing ones
+		for _, be := range svc.Backends {
+			if ebe, exists := esvc.Backends[be.Name]; exists {
+				ebe.Update(be.MaxConnections, nil, nil)
+			} else if s.cfg.UDPServices[name] && be.HealthCheckPort == 0 {
+				logrus.Errorf("Backend %v of udp service %v on cluster %v has no healthCheckPort, ignoring it", be.Name, name, cl.Key)
+			} else {
+				s.addServiceBackend(cl.Key, esvc, be)
+			}
+		}
 
+		// Remove old backends
+		for _, ebe := range esvc.Backends {
+			if _, exists := svc.Backends[ebe.Name]; !exists {
+				logrus.Infof("Backend %v of service %v no longer exists, deleting it from cluster %v", ebe.Name, name, cl.Key)
+				ebe.Stop()
+				delete(esvc.Backends, ebe.Name)
+			}
+		}
+	}
+
+	// Remove old services
+	for name, svc := range cl.Services {
+		if _, exists := services[name]; !exists {
+			logrus.Infof("Service %v no longer exists, deleting it from cluster %v", name, cl.Key)
+			svc.Stop()
+			delete(cl.Services, name)
+		}
+	}
+}
+
+func (s *Scheduler) addServiceBackend(clusterKey string, svc *core.ClusterService, be core.RouterHost) {
+	newBackend := core.NewServiceBackend(be.Name, be.HostIP, be.Port, be.HealthCheckPort, s.healthCheckResults, clusterKey)
+	newBackend.MaxConnections = be.MaxConnections
+	logrus.Infof("New backend was added: %v to service %v. %v:%v", newBackend.Name, svc.Name, newBackend.HostIP, newBackend.Port)
+
+	svc.Backends[newBackend.Name] = newBackend
+}
+
+func (s *Scheduler) UpdateRouterStats(election *core.Election, action StatsOperationAction) {
 	switch action {
 	case IncrementRefused:
-		routerHost.LastState.RefusedConnections++
+		election.RouterHost.IncrementRefused()
+		if election.RouteState != nil {
+			election.RouteState.IncrementRefused()
+		}
+		metrics.RefusedConnections.WithLabelValues(election.RouterHost.ClusterKey, election.RouterHost.Name).Inc()
 	case IncrementConnection:
-		routerHost.LastState.ActiveConnections++
-		routerHost.LastState.TotalConnections++
+		election.RouterHost.IncrementConnection()
+		if election.RouteState != nil {
+			election.RouteState.IncrementConnection()
+		}
+		route := ""
+		if election.Route != nil {
+			route = election.Route.URL
+		}
+		metrics.Connections.WithLabelValues(election.RouterHost.ClusterKey, election.RouterHost.Name, route).Inc()
 	case DecrementConnection:
-		routerHost.LastState.ActiveConnections--
+		election.Release()
+		s.queue.notify()
 	default:
 		logrus.Warn("Don't know how to handle action ", action)
 	}
 }
 
-func (s *Scheduler) ElectRouterHostRequest(ctx core.Context) (*core.RouterHost, error) {
-	r := ElectRequest{ctx, make(chan core.RouterHost), make(chan error)}
+// ElectRouterHostRequest elects a router host for the connection. If all possible router hosts
+// are at their connection limit, the connection waits in the queue for a free slot.
+// The election has to be released with DecrementConnection after the connection is closed.
+func (s *Scheduler) ElectRouterHostRequest(ctx core.Context) (*core.Election, error) {
+	retries := -1
+	elect := func() (*core.Election, error) {
+		retries++
+		return balancing.ElectRouterHost(ctx, s.RoutingTable().Clusters, s.strategy)
+	}
 
-	// Send election request
-	s.elect <- r
+	election, err := elect()
+	if limitErr, limited := err.(*balancing.LimitError); limited && s.queue.enabled() {
+		logrus.Debugf("All router hosts for '%v' are at their connection limit, queueing connection", ctx.Hostname)
+		election, err = s.queue.wait(elect)
+		if err == errQueueFull {
+			logrus.Warnf("Connection queue is full, rejecting connection for '%v'", ctx.Hostname)
+			err = limitErr
+		}
+	}
 
-	select {
-	case err := <-r.Err:
-		return nil, err
+	countElectionError(err)
+	if election != nil {
+		election.Retries = retries
+	}
 
-	case routerHost := <-r.Response:
-		return &routerHost, nil
+	return election, err
+}
+
+// ElectRouterHostNoWait elects a router host like ElectRouterHostRequest, but never waits in the queue.
+// It is used by callers that can't block, like the udp listeners.
+func (s *Scheduler) ElectRouterHostNoWait(ctx core.Context) (*core.Election, error) {
+	election, err := balancing.ElectRouterHost(ctx, s.RoutingTable().Clusters, s.strategy)
+	countElectionError(err)
+
+	return election, err
+}
+
+// countElectionError counts a failed election and the rejection on the limits or routes that caused it
+func countElectionError(err error) {
+	if err == nil {
+		return
+	}
+
+	if deniedErr, denied := err.(*balancing.DeniedError); denied {
+		metrics.ElectionErrors.WithLabelValues(metrics.ElectionErrorDenied).Inc()
+		for _, rs := range deniedErr.RouteStates {
+			rs.IncrementDenied()
+		}
+		return
+	}
+
+	limitErr, limited := err.(*balancing.LimitError)
+	if !limited {
+		metrics.ElectionErrors.WithLabelValues(metrics.ElectionErrorNoRouteHost).Inc()
+		return
+	}
+
+	metrics.ElectionErrors.WithLabelValues(metrics.ElectionErrorLimit).Inc()
+	for _, rh := range limitErr.RouterHosts {
+		rh.IncrementRejected()
+		metrics.RejectedConnections.WithLabelValues(rh.ClusterKey, rh.Name).Inc()
+	}
+	for _, rs := range limitErr.RouteStates {
+		rs.IncrementRejected()
 	}
 }
 
 func (s *Scheduler) routerHosts() []core.RouterHost {
-	s.clusters.mux.Lock()
-	defer s.clusters.mux.Unlock()
 	l := make([]core.RouterHost, 0)
-	for _, c := range s.clusters.v {
+	for _, c := range s.RoutingTable().Clusters {
 		for _, rh := range c.RouterHosts {
-			l = append(l, *rh)
+			l = append(l, rh.Snapshot())
 		}
 	}
 	return l
 }
 
-func (s *Scheduler) resetStats() {
-	s.clusters.mux.Lock()
-	for _, cl := range s.clusters.v {
-		for _, rh := range cl.RouterHosts {
-			rh.LastState.TotalConnections = 0
+// traffic sums the proxied bytes of the router hosts and service backends per cluster and of the routes per hostname
+func (s *Scheduler) traffic() core.Traffic {
+	t := core.Traffic{
+		Clusters: map[string]core.TrafficStats{},
+		Routes:   map[string]core.TrafficStats{},
+	}
+
+	for _, c := range s.RoutingTable().Clusters {
+		cluster := core.TrafficStats{}
+		for _, rh := range c.RouterHosts {
+			cluster.BytesIn += rh.BytesIn()
+			cluster.BytesOut += rh.BytesOut()
+		}
+		for _, svc := range c.Services {
+			for _, be := range svc.Backends {
+				cluster.BytesIn += be.BytesIn()
+				cluster.BytesOut += be.BytesOut()
+			}
+		}
+		t.Clusters[c.Key] = cluster
+
+		for hostname, rs := range c.RouteStates {
+			route := t.Routes[hostname]
+			route.BytesIn += rs.BytesIn()
+			route.BytesOut += rs.BytesOut()
+			t.Routes[hostname] = route
 		}
 	}
-	s.clusters.mux.Unlock()
+
+	return t
 }
 
-func (s *Scheduler) resetRefusedStats(){
-	s.clusters.mux.Lock()
-	for _, cl := range s.clusters.v {
+func (s *Scheduler) resetStats() {
+	for _, cl := range s.RoutingTable().Clusters {
 		for _, rh := range cl.RouterHosts {
-			rh.LastState.RefusedConnections = 0
+			rh.ResetTotalConnections()
+		}
+		for _, rs := range cl.RouteStates {
+			rs.ResetConnections()
 		}
 	}
-	s.clusters.mux.Unlock()
 }
 
-func (s *Scheduler) handleRouterHostElect(req ElectRequest) {
-	s.clusters.mux.Lock()
-	defer s.clusters.mux.Unlock()
-	rh, err := balancing.ElectRouterHost(req.Context, s.clusters.v)
-	if err != nil {
-		req.Err <- err
-		return
+func (s *Scheduler) resetRefusedStats() {
+	for _, cl := range s.RoutingTable().Clusters {
+		for _, rh := range cl.RouterHosts {
+			rh.ResetRefusedConnections()
+		}
 	}
-
-	req.Response <- *rh
 }
 
 func (s *Scheduler) handleHealthCheckResults(res core.HealthCheckResult) {
-	s.clusters.mux.Lock()
-	defer s.clusters.mux.Unlock()
-
 	// Healthy > not healthy
-	if res.RouterHost.LastState.Healthy && !res.Healthy {
+	if res.RouterHost.Healthy() && !res.Healthy {
 		logrus.Warningf("Router host %v on %v degraded", res.RouterHost.Name, res.RouterHost.ClusterKey)
+		s.Events.Publish(events.Event{Type: events.RouterHostUnhealthy, Cluster: res.RouterHost.ClusterKey,
+			RouterHost: res.RouterHost.Name, HostIP: res.RouterHost.HostIP})
 	}
 
 	// Not healthy > healthy
-	if !res.RouterHost.LastState.Healthy && res.Healthy {
+	if !res.RouterHost.Healthy() && res.Healthy {
 		logrus.Infof("Router host %v on %v became healthy", res.RouterHost.Name, res.RouterHost.ClusterKey)
+		s.Events.Publish(events.Event{Type: events.RouterHostHealthy, Cluster: res.RouterHost.ClusterKey,
+			RouterHost: res.RouterHost.Name, HostIP: res.RouterHost.HostIP})
 	}
 
 	// Update state
-	res.RouterHost.LastState.Healthy = res.Healthy
+	res.RouterHost.SetHealthy(res.Healthy)
+	if res.Healthy {
+		// The health check connects like a client would, so it keeps the latency of idle router hosts up to date
+		res.RouterHost.UpdateLatencyEWMA(res.Latency)
+	}
+	metrics.HealthCheckDuration.WithLabelValues(res.RouterHost.ClusterKey, res.RouterHost.Name).Observe(res.Latency.Seconds())
 }
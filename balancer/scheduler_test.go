@@ -0,0 +1,130 @@
+package balancer
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/balancing"
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/core"
+)
+
+// benchmarkScheduler returns a scheduler with a routing table like a migration between
+// three clusters: every cluster has six healthy router hosts and serves the same routes
+// with different weights. The router hosts are not health checked
+func benchmarkScheduler(b *testing.B, routes int, strategy string) (*Scheduler, []string) {
+	s := NewScheduler(SchedulerConfig{Strategy: strategy})
+
+	hostnames := make([]string, routes)
+	for i := range hostnames {
+		hostnames[i] = fmt.Sprintf("app-%v.apps.example.com", i)
+	}
+
+	s.clusters.mux.Lock()
+	defer s.clusters.mux.Unlock()
+	for c, key := range []string{"ose1", "ose2", "ose3"} {
+		clusterRoutes := map[string]core.Route{}
+		for i, hostname := range hostnames {
+			clusterRoutes[fmt.Sprintf("route-%v", i)] = core.Route{URL: hostname, Weight: 1 + (i+c)%10}
+		}
+
+		cl := core.NewCluster(key, clusterRoutes)
+		for i := 0; i < 6; i++ {
+			name := fmt.Sprintf("%v-router-%v", key, i)
+			rh := &core.RouterHost{ClusterKey: key, Name: name, HostIP: fmt.Sprintf("10.%v.0.%v", c, i)}
+			rh.SetHealthy(true)
+			cl.RouterHosts[name] = rh
+		}
+		s.clusters.v[key] = cl
+	}
+	s.publishRoutingTable()
+
+	return s, hostnames
+}
+
+// serializedElector elects like the scheduler did before the routing table snapshot:
+// a single goroutine takes the elections from a channel and runs them under the clusters lock
+type serializedElector struct {
+	s        *Scheduler
+	requests chan *electRequest
+	stop     chan bool
+}
+
+type electRequest struct {
+	ctx      core.Context
+	election *core.Election
+	err      error
+	done     chan bool
+}
+
+func newSerializedElector(s *Scheduler) *serializedElector {
+	e := &serializedElector{s: s, requests: make(chan *electRequest), stop: make(chan bool)}
+	go func() {
+		for {
+			select {
+			case req := <-e.requests:
+				e.s.clusters.mux.Lock()
+				req.election, req.err = balancing.ElectRouterHost(req.ctx, e.s.clusters.v, e.s.strategy)
+				e.s.clusters.mux.Unlock()
+				req.done <- true
+			case <-e.stop:
+				return
+			}
+		}
+	}()
+	return e
+}
+
+func (e *serializedElector) elect(ctx core.Context) (*core.Election, error) {
+	req := &electRequest{ctx: ctx, done: make(chan bool)}
+	e.requests <- req
+	<-req.done
+	return req.election, req.err
+}
+
+// updateRouterStats updates the stats under the clusters lock like the old scheduler
+func (e *serializedElector) updateRouterStats(election *core.Election, action StatsOperationAction) {
+	e.s.clusters.mux.Lock()
+	e.s.UpdateRouterStats(election, action)
+	e.s.clusters.mux.Unlock()
+}
+
+// BenchmarkElectRouterHost elects and releases router hosts from all goroutines of the
+// benchmark like the connections of a busy balancer. The snapshot elections run concurrently
+// on the routing table, the serialized ones go through a single goroutine for comparison
+func BenchmarkElectRouterHost(b *testing.B) {
+	for _, strategy := range []string{balancing.StrategyLeastConn, balancing.StrategyEWMA} {
+		for _, routes := range []int{10, 200} {
+			b.Run(fmt.Sprintf("snapshot/%v/routes=%v", strategy, routes), func(b *testing.B) {
+				s, hostnames := benchmarkScheduler(b, routes, strategy)
+				runElections(b, hostnames, s.ElectRouterHostRequest, s.UpdateRouterStats)
+			})
+
+			b.Run(fmt.Sprintf("serialized/%v/routes=%v", strategy, routes), func(b *testing.B) {
+				s, hostnames := benchmarkScheduler(b, routes, strategy)
+				e := newSerializedElector(s)
+				defer close(e.stop)
+				runElections(b, hostnames, e.elect, e.updateRouterStats)
+			})
+		}
+	}
+}
+
+// runElections elects a router host for the hostnames in turn from all goroutines of the benchmark
+func runElections(b *testing.B, hostnames []string, elect func(core.Context) (*core.Election, error),
+	update func(*core.Election, StatsOperationAction)) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			election, err := elect(core.Context{Hostname: hostnames[i%len(hostnames)]})
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			update(election, IncrementConnection)
+			update(election, DecrementConnection)
+			i++
+		}
+	})
+}
@@ -1,53 +1,152 @@
 package balancer
 
 import (
+	"crypto/tls"
 	"net"
 
 	"time"
 
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/accesslog"
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/balancing"
 	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/core"
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/ratelimit"
 	"github.com/sirupsen/logrus"
 	"strconv"
 )
 
 type BalancerConfig struct {
-	httpListen        string
-	httpsListen       string
+	HTTPListen  string
+	HTTPSListen string
 	//proxyTimeout      time.Duration
-	routerHostTimeout time.Duration
+	RouterHostTimeout time.Duration
+
+	Scheduler SchedulerConfig
+	RateLimit ratelimit.Config
+
+	// Client ips or CIDRs that may or may not use the balancer. An empty allow list allows everyone
+	AllowedSources []string
+	DeniedSources  []string
+
+	// ProxyProtocol is the PROXY protocol version sent to router hosts of clusters without their own setting
+	ProxyProtocol string
+
+	// AcceptProxyProtocolFrom are the ips or CIDRs of trusted load balancers in front of
+	// the balancer that send a PROXY protocol header. Empty disables the header parsing
+	AcceptProxyProtocolFrom []string
+
+	// ForwardedHeaders adds X-Forwarded-* and Forwarded headers to the first or all
+	// requests of plain http connections. See core.ForwardedHeaders* for the modes
+	ForwardedHeaders string
+
+	// HTTPRequestBalancing elects a router host for every request of plain http connections
+	// instead of once per connection. Connections to the router hosts are pooled
+	HTTPRequestBalancing bool
+
+	// CertificateDir contains the certificates to terminate TLS for routes that ask for it
+	CertificateDir string
+
+	// ReencryptInsecureSkipVerify skips the verification of router host certificates on re-encrypted connections
+	ReencryptInsecureSkipVerify bool
+
+	// PlainHTTPOnHTTPS defines how plain http clients on the https listener are handled. See PlainHTTP* for the modes
+	PlainHTTPOnHTTPS string
+
+	// DefaultCluster gets the TLS connections without SNI hostname. Empty closes them with a TLS alert
+	DefaultCluster string
+
+	// TCPListeners are the listen addresses of the tcp services by service name
+	TCPListeners map[string]string
+
+	// UDPListeners are the listen addresses of the udp services by service name. Sessions
+	// of udp clients are closed after UDPSessionTimeout without packets
+	UDPListeners      map[string]string
+	UDPSessionTimeout time.Duration
+
+	// AccessLog writes an entry for every proxied connection
+	AccessLog accesslog.Config
 }
 
 type Balancer struct {
 	clients   map[string]net.Conn
 	Scheduler *Scheduler
+	limiter   *ratelimit.Limiter
+	sources   *core.SourceFilter
+
+	// Certificates to terminate TLS, selected by SNI
+	Certificates *core.CertificateStore
+	tlsConfig    *tls.Config
+
+	// proxyProtocolSources is nil if no inbound PROXY protocol is accepted
+	proxyProtocolSources *core.SourceFilter
 
 	cfg           BalancerConfig
 	httpListener  net.Listener
 	httpsListener net.Listener
 
+	// requestBalancer is nil if http connections are balanced as a whole
+	requestBalancer *requestBalancer
+
+	// accessLog is nil if it is disabled
+	accessLog *accesslog.Logger
+
 	// Channels
 	connect    chan *core.Context
 	disconnect chan net.Conn
 	stop       chan bool
 }
 
-func NewBalancer(httpListenCfg string, httpsListenCfg string) *Balancer {
-	return &Balancer{
-		Scheduler: NewScheduler(),
-		cfg: BalancerConfig{
-			httpListen:        httpListenCfg,
-			httpsListen:       httpsListenCfg,
-			//proxyTimeout:      10 * time.Second,
-			routerHostTimeout: 5 * time.Second,
-		},
-		clients:    make(map[string]net.Conn),
-		connect:    make(chan *core.Context),
-		disconnect: make(chan net.Conn),
-		stop:       make(chan bool),
+func NewBalancer(cfg BalancerConfig) *Balancer {
+	cfg.Scheduler.UDPServices = map[string]bool{}
+	for service := range cfg.UDPListeners {
+		cfg.Scheduler.UDPServices[service] = true
 	}
+
+	b := &Balancer{
+		Scheduler:    NewScheduler(cfg.Scheduler),
+		limiter:      ratelimit.NewLimiter(cfg.RateLimit),
+		sources:      core.NewSourceFilter(cfg.AllowedSources, cfg.DeniedSources),
+		Certificates: core.NewCertificateStore(),
+		cfg:          cfg,
+		clients:      make(map[string]net.Conn),
+		connect:      make(chan *core.Context),
+		disconnect:   make(chan net.Conn),
+		stop:         make(chan bool),
+	}
+
+	b.tlsConfig = &tls.Config{
+		GetCertificate: b.Certificates.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"http/1.1"},
+	}
+
+	if len(cfg.AcceptProxyProtocolFrom) > 0 {
+		b.proxyProtocolSources = core.NewSourceFilter(cfg.AcceptProxyProtocolFrom, nil)
+	}
+
+	return b
 }
 
 func (b *Balancer) Start() error {
+	if len(b.cfg.CertificateDir) > 0 {
+		if err := b.Certificates.LoadDir(b.cfg.CertificateDir); err != nil {
+			logrus.Error("Error loading certificates from "+b.cfg.CertificateDir, err)
+			return err
+		}
+	}
+
+	accessLog, err := accesslog.New(b.cfg.AccessLog)
+	if err != nil {
+		logrus.Error("Error opening access log "+b.cfg.AccessLog.Path, err)
+		return err
+	}
+	b.accessLog = accessLog
+
+	if err := b.Scheduler.StatsHandler.OpenHistory(); err != nil {
+		logrus.Error("Error opening stats history "+b.cfg.Scheduler.Stats.HistoryDir, err)
+		b.accessLog.Close()
+		return err
+	}
+
 	go func() {
 		for {
 			select {
@@ -75,6 +174,18 @@ func (b *Balancer) Start() error {
 		b.Stop()
 		return err
 	}
+	for service, addr := range b.cfg.TCPListeners {
+		if err := b.ListenTCP(service, addr); err != nil {
+			b.Stop()
+			return err
+		}
+	}
+	for service, addr := range b.cfg.UDPListeners {
+		if err := b.ListenUDP(service, addr); err != nil {
+			b.Stop()
+			return err
+		}
+	}
 
 	return nil
 }
@@ -84,6 +195,10 @@ func (b *Balancer) Stop() {
 
 	logrus.Info("Shutting down load balancer. This will disconnect all clients")
 
+	if b.requestBalancer != nil {
+		b.requestBalancer.Close()
+	}
+
 	for _, conn := range b.clients {
 		logrus.Debugf("Closing connection to client: %v", b.clients)
 		conn.Close()
@@ -91,6 +206,8 @@ func (b *Balancer) Stop() {
 
 	// Create new empty client list
 	b.clients = make(map[string]net.Conn)
+
+	b.accessLog.Close()
 }
 
 func (b *Balancer) HandleClientDisconnect(client net.Conn) {
@@ -112,9 +229,9 @@ func (b *Balancer) HandleClientConnect(ctx *core.Context) {
 }
 
 func (b *Balancer) ListenHttps() (err error) {
-	b.httpsListener, err = net.Listen("tcp", b.cfg.httpsListen)
+	b.httpsListener, err = net.Listen("tcp", b.cfg.HTTPSListen)
 	if err != nil {
-		logrus.Error("Error starting https listener on "+b.cfg.httpsListen, err)
+		logrus.Error("Error starting https listener on "+b.cfg.HTTPSListen, err)
 		return err
 	}
 
@@ -126,19 +243,19 @@ func (b *Balancer) ListenHttps() (err error) {
 				return
 			}
 
-			go b.wrapHttpsConnection(conn)
+			go b.acceptConnection(conn, true, time.Now())
 		}
 	}()
 
-	logrus.Info("Started global https listener on " + b.cfg.httpsListen)
+	logrus.Info("Started global https listener on " + b.cfg.HTTPSListen)
 
 	return nil
 }
 
 func (b *Balancer) ListenHttp() (err error) {
-	b.httpListener, err = net.Listen("tcp", b.cfg.httpListen)
+	b.httpListener, err = net.Listen("tcp", b.cfg.HTTPListen)
 	if err != nil {
-		logrus.Error("Error starting http listener on "+b.cfg.httpListen, err)
+		logrus.Error("Error starting http listener on "+b.cfg.HTTPListen, err)
 		return err
 	}
 
@@ -150,33 +267,218 @@ func (b *Balancer) ListenHttp() (err error) {
 				return
 			}
 
-			go b.wrapHttpConnection(conn)
+			go b.acceptConnection(conn, false, time.Now())
+		}
+	}()
+
+	if b.cfg.HTTPRequestBalancing {
+		b.requestBalancer = newRequestBalancer(b, b.httpListener.Addr())
+	}
+
+	logrus.Info("Started global http listener on " + b.cfg.HTTPListen)
+
+	return nil
+}
+
+// ListenTCP starts a listener for the tcp service
+func (b *Balancer) ListenTCP(service string, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		logrus.Errorf("Error starting tcp listener for service %v on %v: %v", service, addr, err)
+		return err
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				logrus.Error(err)
+				return
+			}
+
+			go b.acceptTCPConnection(conn, service, time.Now())
 		}
 	}()
 
-	logrus.Info("Started global http listener on " + b.cfg.httpListen)
+	logrus.Infof("Started tcp listener for service %v on %v", service, addr)
 
 	return nil
 }
 
-func (b *Balancer) wrapHttpsConnection(conn net.Conn) {
+// acceptConnection reads the PROXY protocol header of trusted sources and checks the
+// limits of the client before the connection is handled
+func (b *Balancer) acceptConnection(conn net.Conn, https bool, accepted time.Time) {
+	conn, ok := b.readProxyProtocolHeader(conn)
+	if !ok {
+		return
+	}
+
+	listener := "http"
+	if https {
+		listener = "https"
+	}
+	if !b.globalSourceAllowed(conn, listener, accepted) {
+		return
+	}
+
+	conn, ok = b.admitConnection(conn, !https)
+	if !ok {
+		return
+	}
+
+	if https {
+		b.wrapHttpsConnection(conn, accepted)
+	} else {
+		b.wrapHttpConnection(conn, accepted)
+	}
+}
+
+// acceptTCPConnection is acceptConnection for the listeners of tcp services
+func (b *Balancer) acceptTCPConnection(conn net.Conn, service string, accepted time.Time) {
+	conn, ok := b.readProxyProtocolHeader(conn)
+	if !ok {
+		return
+	}
+
+	if !b.globalSourceAllowed(conn, "tcp:"+service, accepted) {
+		return
+	}
+
+	conn, ok = b.admitConnection(conn, false)
+	if !ok {
+		return
+	}
+
+	b.connect <- &core.Context{
+		Service:  service,
+		Conn:     core.NewBufferedConn(conn),
+		Accepted: accepted,
+	}
+}
+
+// readProxyProtocolHeader reads the PROXY protocol header if the client is a trusted load balancer
+func (b *Balancer) readProxyProtocolHeader(conn net.Conn) (net.Conn, bool) {
+	if b.proxyProtocolSources == nil || !b.proxyProtocolSources.Allowed(core.AddrIP(conn.RemoteAddr())) {
+		return conn, true
+	}
+
+	proxiedConn, err := core.ReadProxyProtocolHeader(conn, 5*time.Second)
+	if err != nil {
+		logrus.Errorf("Failed to read PROXY protocol header from %v: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return nil, false
+	}
+	return proxiedConn, true
+}
+
+// globalSourceAllowed closes the connection if the client is not allowed by the global allow
+// and deny lists. It runs before the rate limits and the election, so denied clients take no slot
+func (b *Balancer) globalSourceAllowed(conn net.Conn, listener string, accepted time.Time) bool {
+	if b.sources.Allowed(core.AddrIP(conn.RemoteAddr())) {
+		return true
+	}
+
+	logrus.Warnf("Client %v is not allowed to use the balancer. Closing connection", conn.RemoteAddr())
+	b.accessLog.Log(&accesslog.Entry{
+		Time:        accepted,
+		Client:      conn.RemoteAddr().String(),
+		Listener:    listener,
+		CloseReason: accesslog.CloseDenied,
+	})
+	conn.Close()
+	return false
+}
+
+// admitConnection checks the rate limits for a new connection. Connections over
+// the limits are closed, plain http clients get a 429 response first.
+func (b *Balancer) admitConnection(conn net.Conn, plainHTTP bool) (net.Conn, bool) {
+	release, err := b.limiter.Acquire(conn.RemoteAddr())
+	if err == nil {
+		return core.NewReleaseConn(conn, release), true
+	}
+
+	logrus.Debugf("Closing connection from %v: %v", conn.RemoteAddr(), err)
+	b.Scheduler.StatsHandler.IncrementRateLimited()
+
+	if plainHTTP {
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		conn.Write(tooManyRequestsResponse)
+	}
+	conn.Close()
+
+	return nil, false
+}
+
+var tooManyRequestsResponse = []byte("HTTP/1.1 429 Too Many Requests\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+
+func (b *Balancer) wrapHttpsConnection(conn net.Conn, accepted time.Time) {
 	// Get hostname based on SNI protocol
-	sniConn, hostname, err := core.Sniff(conn, 5*time.Second)
+	sniConn, hello, err := core.Sniff(conn, 5*time.Second)
+	if err == core.ErrNotTLS {
+		b.handlePlainHTTPOnHTTPS(sniConn, accepted)
+		return
+	}
 	if err != nil {
 		logrus.Error("Failed to get / parse ClientHello for sni: ", err)
 		conn.Close()
 		return
 	}
+	hostname := hello.ServerName
 	logrus.Debugf("Hostname is: %v", hostname)
 
-	b.connect <- &core.Context{
+	if b.terminatesTLS(hostname) {
+		b.terminateTLSConnection(sniConn, hostname, accepted)
+		return
+	}
+
+	ctx := &core.Context{
 		Hostname: hostname,
 		HTTPS:    true,
+		ALPN:     hello.ALPNProtocols,
 		Conn:     core.NewBufferedConn(sniConn),
+		Accepted: accepted,
 	}
+
+	if len(hostname) == 0 {
+		b.Scheduler.StatsHandler.IncrementMissingSNI()
+		if len(b.cfg.DefaultCluster) == 0 {
+			b.rejectMissingSNI(sniConn)
+			return
+		}
+		ctx.Cluster = b.cfg.DefaultCluster
+	}
+
+	b.connect <- ctx
+}
+
+// terminatesTLS returns true if a route of hostname wants TLS termination and there is a certificate for it
+func (b *Balancer) terminatesTLS(hostname string) bool {
+	return len(hostname) > 0 && b.Certificates.Get(hostname) != nil &&
+		b.Scheduler.RoutingTable().TerminatesTLS(hostname)
 }
 
-func (b *Balancer) wrapHttpConnection(conn net.Conn) {
+// terminateTLSConnection does the TLS handshake with the client and handles the decrypted http traffic
+func (b *Balancer) terminateTLSConnection(conn net.Conn, hostname string, accepted time.Time) {
+	tlsConn := tls.Server(conn, b.tlsConfig)
+
+	tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		logrus.Errorf("TLS handshake with %v failed: %v", conn.RemoteAddr(), err)
+		tlsConn.Close()
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	b.connect <- &core.Context{
+		Hostname:   hostname,
+		HTTPS:      true,
+		Terminated: true,
+		Conn:       core.NewBufferedConn(tlsConn),
+		Accepted:   accepted,
+	}
+}
+
+func (b *Balancer) wrapHttpConnection(conn net.Conn, accepted time.Time) {
 	// Get hostname out of http host header or take host value
 	bufConn := core.NewBufferedConn(conn)
 	hostname := core.HttpHostHeader(bufConn.Reader)
@@ -186,6 +488,7 @@ func (b *Balancer) wrapHttpConnection(conn net.Conn) {
 		Hostname: hostname,
 		HTTPS:    false,
 		Conn:     core.NewBufferedConn(bufConn),
+		Accepted: accepted,
 	}
 }
 
@@ -194,45 +497,179 @@ func (b *Balancer) handleConnection(ctx *core.Context) {
 
 	logrus.Debug("Accepted connection from ", clientConn.RemoteAddr())
 
-	// Find a router host that is healthy to forward the request to
-	var err error
-	routerHost, err := b.Scheduler.ElectRouterHostRequest(*ctx)
-	if err != nil {
-		logrus.Error(err, ". Closing connection: ", clientConn.RemoteAddr())
+	if ctx.PlainHTTP() && b.requestBalancer != nil {
+		b.requestBalancer.serveConnection(ctx)
 		return
 	}
 
-	var port int
-	if ctx.HTTPS {
-		port = routerHost.HTTPSPort
-	} else {
-		port = routerHost.HTTPPort
+	entry := newAccessLogEntry(ctx)
+	defer b.accessLog.Log(entry)
+
+	// Find a router host that is healthy to forward the request to.
+	// The allow and deny lists of the route are checked in the election
+	ctx.Client = core.AddrIP(clientConn.RemoteAddr())
+	election, err := b.Scheduler.ElectRouterHostRequest(*ctx)
+	if err != nil {
+		logrus.Error(err, ". Closing connection: ", clientConn.RemoteAddr())
+		entry.CloseReason = electionErrorReason(err)
+		return
 	}
+	defer b.Scheduler.UpdateRouterStats(election, DecrementConnection)
+	routerHost := election.RouterHost
+	entry.SetElection(election)
 
+	port, reencrypt := routerHostPort(ctx, election)
 	logrus.Debugf("Selected target router host: %v in port %v", routerHost.Name, port)
 
 	// Connect to router host
-	routerHostConn, err := net.DialTimeout("tcp", routerHost.HostIP+":"+strconv.Itoa(port), b.cfg.routerHostTimeout)
-	bufferedRouterHostConn := core.NewBufferedConn(routerHostConn)
+	dialStarted := time.Now()
+	routerHostConn, err := net.DialTimeout("tcp", routerHost.HostIP+":"+strconv.Itoa(port), b.cfg.RouterHostTimeout)
 	if err != nil {
-		b.Scheduler.UpdateRouterStats(routerHost.ClusterKey, routerHost.Name, IncrementRefused)
+		routerHost.ObserveDialError(time.Since(dialStarted), b.cfg.RouterHostTimeout)
+		b.Scheduler.UpdateRouterStats(election, IncrementRefused)
 		logrus.Errorf("Error connecting to router host: %v. Err: %v", routerHost.Name, err)
+		entry.CloseReason = accesslog.CloseDialError
+		return
+	}
+	routerHost.ObserveDial(time.Since(dialStarted))
+
+	// Tell the router host who the client is
+	if err := b.writeProxyProtocolHeader(routerHostConn, clientConn, election); err != nil {
+		b.Scheduler.UpdateRouterStats(election, IncrementRefused)
+		routerHostConn.Close()
+		logrus.Errorf("Error sending PROXY protocol header to router host: %v. Err: %v", routerHost.Name, err)
+		entry.CloseReason = accesslog.CloseProxyProtocol
 		return
 	}
-	b.Scheduler.UpdateRouterStats(routerHost.ClusterKey, routerHost.Name, IncrementConnection)
-	defer b.Scheduler.UpdateRouterStats(routerHost.ClusterKey, routerHost.Name, DecrementConnection)
+
+	if reencrypt {
+		tlsConn := tls.Client(routerHostConn, b.reencryptConfig(ctx.Hostname))
+		tlsConn.SetDeadline(time.Now().Add(b.cfg.RouterHostTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			b.Scheduler.UpdateRouterStats(election, IncrementRefused)
+			tlsConn.Close()
+			logrus.Errorf("TLS handshake with router host: %v failed. Err: %v", routerHost.Name, err)
+			entry.CloseReason = accesslog.CloseTLSError
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		routerHostConn = tlsConn
+	}
+	entry.SetDialTime(dialStarted)
+	routerHost.ObserveTimeToFirstByte(time.Since(ctx.Accepted))
+	bufferedRouterHostConn := core.NewBufferedConn(routerHostConn)
+	b.Scheduler.UpdateRouterStats(election, IncrementConnection)
 
 	// Proxy the request & response bytes
-	doneRxChan := core.Proxy(clientConn, bufferedRouterHostConn)
-	doneTxChan := core.Proxy(bufferedRouterHostConn, clientConn)
+	doneRxChan := core.Proxy(clientConn, bufferedRouterHostConn, election.AddBytesOut)
+	var doneTxChan <-chan uint64
+	if ctx.PlainHTTP() && b.cfg.ForwardedHeaders != core.ForwardedHeadersNone && len(b.cfg.ForwardedHeaders) > 0 {
+		info := core.ForwardedInfo{
+			ClientAddr: clientConn.RemoteAddr(),
+			LocalAddr:  clientConn.LocalAddr(),
+			Proto:      "http",
+		}
+		if ctx.HTTPS {
+			info.Proto = "https"
+		}
+		everyRequest := b.cfg.ForwardedHeaders == core.ForwardedHeadersAll
+		doneTxChan = core.ProxyHTTPRequests(bufferedRouterHostConn, clientConn, info, everyRequest, election.AddBytesIn)
+	} else {
+		doneTxChan = core.Proxy(bufferedRouterHostConn, clientConn, election.AddBytesIn)
+	}
 
+	var count core.ReadWriteCount
 	isTx, isRx := true, true
 	for isTx || isRx {
 		select {
-		case <-doneRxChan:
+		case count.CountWrite = <-doneRxChan:
 			isRx = false
-		case <-doneTxChan:
+			if isTx {
+				entry.CloseReason = accesslog.CloseRouterHost
+			}
+		case count.CountRead = <-doneTxChan:
 			isTx = false
+			if isRx {
+				entry.CloseReason = accesslog.CloseClient
+			}
 		}
 	}
+	entry.BytesIn, entry.BytesOut = count.CountRead, count.CountWrite
+	routerHost.ObserveLifetime(time.Since(ctx.Accepted))
+	logrus.Debugf("Closed connection of %v to router host %v. Bytes in: %v, out: %v",
+		clientConn.RemoteAddr(), routerHost.Name, count.CountRead, count.CountWrite)
+}
+
+// newAccessLogEntry starts the access log entry of the connection
+func newAccessLogEntry(ctx *core.Context) *accesslog.Entry {
+	entry := &accesslog.Entry{
+		Time:     ctx.Accepted,
+		Client:   ctx.Conn.RemoteAddr().String(),
+		Listener: "http",
+		Hostname: ctx.Hostname,
+	}
+	if len(ctx.Service) > 0 {
+		entry.Listener = "tcp:" + ctx.Service
+	} else if ctx.HTTPS {
+		entry.Listener = "https"
+	}
+	return entry
+}
+
+// electionErrorReason returns the close reason for connections without router host
+func electionErrorReason(err error) string {
+	if _, denied := err.(*balancing.DeniedError); denied {
+		return accesslog.CloseDenied
+	}
+	if _, limited := err.(*balancing.LimitError); limited {
+		return accesslog.CloseLimit
+	}
+	return accesslog.CloseNoRouterHost
+}
+
+// routerHostPort returns the port of the elected router host for the connection and whether
+// the connection to it has to be encrypted again by the balancer
+func routerHostPort(ctx *core.Context, election *core.Election) (int, bool) {
+	if len(ctx.Service) > 0 {
+		return election.RouterHost.Port, false
+	}
+	if !ctx.HTTPS {
+		return election.RouterHost.HTTPPort, false
+	}
+	if !ctx.Terminated {
+		return election.RouterHost.HTTPSPortFor(election.ALPN), false
+	}
+
+	// Routes that don't want termination on this cluster still get TLS towards the router host
+	if election.Route != nil && election.Route.TLSTermination == core.TLSEdge {
+		return election.RouterHost.HTTPPort, false
+	}
+	return election.RouterHost.HTTPSPort, true
+}
+
+// reencryptConfig is the TLS config for connections to router hosts of terminated connections
+func (b *Balancer) reencryptConfig(hostname string) *tls.Config {
+	return &tls.Config{
+		ServerName:         hostname,
+		InsecureSkipVerify: b.cfg.ReencryptInsecureSkipVerify,
+		NextProtos:         []string{"http/1.1"},
+	}
+}
+
+// writeProxyProtocolHeader sends the PROXY protocol header if it is enabled for the cluster of the router host
+func (b *Balancer) writeProxyProtocolHeader(routerHostConn net.Conn, clientConn net.Conn, election *core.Election) error {
+	return core.WriteProxyProtocolHeader(routerHostConn, b.proxyProtocolVersion(election),
+		clientConn.RemoteAddr(), clientConn.LocalAddr())
+}
+
+// proxyProtocolVersion returns the PROXY protocol version for the cluster of the elected router host.
+// Backends of tcp services don't get a header
+func (b *Balancer) proxyProtocolVersion(election *core.Election) string {
+	if len(election.Service) > 0 {
+		return core.ProxyProtocolNone
+	}
+	if election.Cluster != nil && len(election.Cluster.ProxyProtocol) > 0 {
+		return election.Cluster.ProxyProtocol
+	}
+	return b.cfg.ProxyProtocol
 }
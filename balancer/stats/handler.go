@@ -2,52 +2,169 @@ package stats
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/core"
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/events"
 	"github.com/sirupsen/logrus"
 )
 
+// Defaults of the Config
+const (
+	DefaultInterval      = 2 * time.Second
+	DefaultRetention     = 80 * time.Second
+	DefaultRollupSamples = 288
+)
+
+type Config struct {
+	// Interval between two samples of the live stats
+	Interval time.Duration
+
+	// Retention is the time range of the live stats
+	Retention time.Duration
+
+	// RollupSamples are the samples kept per rollup resolution, 288 cover a day in 5m
+	RollupSamples int
+
+	// HistoryDir stores every sample of the router hosts and routes on disk if it is set.
+	// Samples older than HistoryRetention are removed, 0 keeps all of them
+	HistoryDir       string
+	HistoryRetention time.Duration
+}
+
 type SafeStats struct {
 	v   core.GlobalStats
 	mux sync.Mutex
 }
 
 type StatsHandler struct {
+	cfg      Config
+	maxTicks int
+
 	// State
 	stats           SafeStats
+	rollups         map[string]*rollup
+	history         *History
+	events          *events.Bus
 	lastConnections uint
+	rateLimited     uint64
+	plainHTTP       uint64
+	missingSNI      uint64
+
+	// Time of the previous updates to calculate the throughput
+	lastHostsUpdate   time.Time
+	lastTraffic       core.Traffic
+	lastTrafficUpdate time.Time
 
 	// Async communication
-	Connections    chan uint
-	RouterHosts    chan []core.RouterHost
-	StatsTick      chan core.GlobalStats
-	stop           chan bool
+	Connections chan uint
+	RouterHosts chan []core.RouterHost
+	Traffic     chan core.Traffic
+	RouteStats  chan map[string]core.RouteStats
+	StatsTick   chan core.GlobalStats
+	stop        chan bool
 }
 
-func NewHandler() *StatsHandler {
+// NewHandler returns a handler that publishes a stats event with every sample on bus
+func NewHandler(cfg Config, bus *events.Bus) *StatsHandler {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.Retention < cfg.Interval {
+		cfg.Retention = DefaultRetention
+	}
+	if cfg.RollupSamples <= 0 {
+		cfg.RollupSamples = DefaultRollupSamples
+	}
+
+	rollups := make(map[string]*rollup, len(rollupResolutions))
+	for name, resolution := range rollupResolutions {
+		rollups[name] = newRollup(resolution, cfg.RollupSamples)
+	}
+
 	return &StatsHandler{
-		stats: SafeStats{v: core.GlobalStats{
-			Mutation:           "stats",
-			HealthyHosts:       []int{},
-			UnhealthyHosts:     []int{},
-			Hosts:              make(map[string]core.RouterHostWithStats),
-			OverallConnections: []uint{},
-			Ticks:              []string{},
-		}},
+		cfg:             cfg,
+		maxTicks:        int(cfg.Retention / cfg.Interval),
+		stats:           SafeStats{v: newGlobalStats()},
+		rollups:         rollups,
+		events:          bus,
 		lastConnections: 0,
 
-		Connections:    make(chan uint, 1),
-		RouterHosts:    make(chan []core.RouterHost),
-		StatsTick:      make(chan core.GlobalStats),
-		stop:           make(chan bool),
+		Connections: make(chan uint, 1),
+		RouterHosts: make(chan []core.RouterHost),
+		Traffic:     make(chan core.Traffic),
+		RouteStats:  make(chan map[string]core.RouteStats),
+		StatsTick:   make(chan core.GlobalStats),
+		stop:        make(chan bool),
+	}
+}
+
+func newGlobalStats() core.GlobalStats {
+	return core.GlobalStats{
+		Mutation:           "stats",
+		HealthyHosts:       []int{},
+		UnhealthyHosts:     []int{},
+		Hosts:              make(map[string]core.RouterHostWithStats),
+		OverallConnections: []uint{},
+		RateLimited:        []uint64{},
+		PlainHTTPOnHTTPS:   []uint64{},
+		MissingSNI:         []uint64{},
+		Clusters:           map[string][]core.TrafficStats{},
+		Routes:             map[string][]core.TrafficStats{},
+		RouteStats:         map[string]core.RouteStats{},
+		Ticks:              []string{},
 	}
 }
 
+// OpenHistory opens the on-disk history if a directory is configured
+func (s *StatsHandler) OpenHistory() error {
+	history, err := OpenHistory(s.cfg.HistoryDir, s.cfg.HistoryRetention)
+	if err != nil {
+		return err
+	}
+	s.history = history
+	return nil
+}
+
+// History returns the stored samples of the query
+func (s *StatsHandler) History(q HistoryQuery) ([]core.HistorySample, error) {
+	return s.history.Query(q)
+}
+
+// Interval returns the time between two samples of the live stats
+func (s *StatsHandler) Interval() time.Duration {
+	return s.cfg.Interval
+}
+
+// Stats returns the series in the resolution. False if the resolution is unknown
+func (s *StatsHandler) Stats(resolution string) (core.GlobalStats, bool) {
+	s.stats.mux.Lock()
+	defer s.stats.mux.Unlock()
+
+	if resolution == ResolutionLive {
+		return copyStats(s.stats.v), true
+	}
+
+	r, ok := s.rollups[resolution]
+	if !ok {
+		return core.GlobalStats{}, false
+	}
+	stats := r.series()
+	stats.RouteStats = s.stats.v.RouteStats
+	for name, rh := range stats.Hosts {
+		if live, ok := s.stats.v.Hosts[name]; ok {
+			rh.Latency = live.Latency
+			stats.Hosts[name] = rh
+		}
+	}
+	return stats, true
+}
+
 func (s *StatsHandler) Start() {
 	logrus.Info("Started StatsHandler")
 
-	UIPushTicker := time.NewTicker(2 * time.Second)
+	UIPushTicker := time.NewTicker(s.cfg.Interval)
 
 	go func() {
 		for {
@@ -61,7 +178,18 @@ func (s *StatsHandler) Start() {
 			case c := <-s.RouterHosts:
 				s.updateRouterHosts(c)
 
+			case t := <-s.Traffic:
+				s.updateTraffic(t)
+
+			case rs := <-s.RouteStats:
+				s.stats.mux.Lock()
+				s.stats.v.RouteStats = rs
+				s.stats.mux.Unlock()
+
 			case <-s.stop:
+				if err := s.history.Close(); err != nil {
+					logrus.Warn("Failed to close stats history: ", err)
+				}
 				logrus.Info("Stopped StatsHandler")
 				return
 			}
@@ -73,9 +201,28 @@ func (s *StatsHandler) Stop() {
 	s.stop <- true
 }
 
+// IncrementRateLimited counts a connection that was closed because of a rate limit
+func (s *StatsHandler) IncrementRateLimited() {
+	atomic.AddUint64(&s.rateLimited, 1)
+}
+
+// IncrementPlainHTTPOnHTTPS counts a plain http connection on the https listener
+func (s *StatsHandler) IncrementPlainHTTPOnHTTPS() {
+	atomic.AddUint64(&s.plainHTTP, 1)
+}
+
+// IncrementMissingSNI counts a TLS connection without SNI hostname
+func (s *StatsHandler) IncrementMissingSNI() {
+	atomic.AddUint64(&s.missingSNI, 1)
+}
+
 func (s *StatsHandler) updateRouterHosts(rhs []core.RouterHost) {
 	logrus.Debug("Got a update of the router host map in StatsHandler")
 
+	now := time.Now()
+	elapsed := now.Sub(s.lastHostsUpdate)
+	s.lastHostsUpdate = now
+
 	s.stats.mux.Lock()
 	updated := map[string]core.RouterHostWithStats{}
 
@@ -87,7 +234,10 @@ func (s *StatsHandler) updateRouterHosts(rhs []core.RouterHost) {
 			// if we have this router host, update the health state
 			logrus.Debugf("Updating existing router %v", rh.Name)
 
-			oldRH.Stats = append(oldRH.Stats, rh.LastState)
+			state := rh.LastState()
+			state.TrafficStats = throughput(oldRH.Stats[len(oldRH.Stats)-1].TrafficStats, state.TrafficStats, elapsed)
+			oldRH.Stats = append(oldRH.Stats, state)
+			oldRH.Latency = rh.LatencyStats()
 
 			oldRH = s.updateRouterHostStats(oldRH)
 
@@ -102,10 +252,11 @@ func (s *StatsHandler) updateRouterHosts(rhs []core.RouterHost) {
 				HTTPPort:   rh.HTTPPort,
 				HTTPSPort:  rh.HTTPSPort,
 				Stats:      []core.HostStats{},
+				Latency:    rh.LatencyStats(),
 			}
 
 			newRH = s.updateRouterHostStats(newRH)
-			newRH.Stats = append(newRH.Stats, rh.LastState)
+			newRH.Stats = append(newRH.Stats, rh.LastState())
 
 			updated[rh.Name] = newRH
 		}
@@ -115,11 +266,64 @@ func (s *StatsHandler) updateRouterHosts(rhs []core.RouterHost) {
 	s.stats.mux.Unlock()
 }
 
+// updateTraffic appends the traffic of the clusters and routes to their series. Clusters and
+// routes that no longer exist are removed
+func (s *StatsHandler) updateTraffic(t core.Traffic) {
+	now := time.Now()
+	elapsed := now.Sub(s.lastTrafficUpdate)
+	s.lastTrafficUpdate = now
+
+	s.stats.mux.Lock()
+	s.stats.v.Clusters = appendTraffic(s.stats.v.Clusters, s.lastTraffic.Clusters, t.Clusters, elapsed, s.maxTicks)
+	s.stats.v.Routes = appendTraffic(s.stats.v.Routes, s.lastTraffic.Routes, t.Routes, elapsed, s.maxTicks)
+	s.stats.mux.Unlock()
+
+	s.lastTraffic = t
+}
+
+func appendTraffic(series map[string][]core.TrafficStats, last map[string]core.TrafficStats,
+	current map[string]core.TrafficStats, elapsed time.Duration, maxTicks int) map[string][]core.TrafficStats {
+
+	updated := make(map[string][]core.TrafficStats, len(current))
+	for key, cur := range current {
+		stats := series[key]
+		if len(stats) >= maxTicks {
+			stats = stats[1:]
+		} else {
+			for i := 0; i <= maxTicks; i++ {
+				stats = append(stats, core.TrafficStats{})
+			}
+		}
+
+		if prev, ok := last[key]; ok {
+			cur = throughput(prev, cur, elapsed)
+		}
+		updated[key] = append(stats, cur)
+	}
+
+	return updated
+}
+
+// throughput sets the bytes per second of cur since prev. Counters that went down
+// because router hosts were removed count as no traffic
+func throughput(prev core.TrafficStats, cur core.TrafficStats, elapsed time.Duration) core.TrafficStats {
+	if elapsed <= 0 {
+		return cur
+	}
+	if cur.BytesIn > prev.BytesIn {
+		cur.ThroughputIn = float64(cur.BytesIn-prev.BytesIn) / elapsed.Seconds()
+	}
+	if cur.BytesOut > prev.BytesOut {
+		cur.ThroughputOut = float64(cur.BytesOut-prev.BytesOut) / elapsed.Seconds()
+	}
+	return cur
+}
+
 func (s *StatsHandler) updateRouterHostStats(rh core.RouterHostWithStats) core.RouterHostWithStats {
-	if len(rh.Stats) >= core.MaxTicks {
+	if len(rh.Stats) >= s.maxTicks {
 		rh.Stats = rh.Stats[1:]
 	} else {
-		for i := 0; i <= core.MaxTicks; i++ {
+		for i := 0; i <= s.maxTicks; i++ {
 			rh.Stats = append(rh.Stats, core.HostStats{})
 		}
 	}
@@ -133,11 +337,10 @@ func (s *StatsHandler) updateGlobalStats() {
 	healthyHosts := 0
 
 	s.stats.mux.Lock()
-	defer s.stats.mux.Unlock()
 
 	// Update stats for every router host
 	for _, rh := range s.stats.v.Hosts {
-		if rh.Stats[len(rh.Stats) -1].Healthy {
+		if rh.Stats[len(rh.Stats)-1].Healthy {
 			healthyHosts++
 		} else {
 			unhealthyHosts++
@@ -149,25 +352,139 @@ func (s *StatsHandler) updateGlobalStats() {
 	// })
 
 	// Create a list of ticks and connections for the UI
-	if len(s.stats.v.Ticks) >= core.MaxTicks {
+	now := time.Now()
+	if len(s.stats.v.Ticks) >= s.maxTicks {
 		s.stats.v.Ticks = s.stats.v.Ticks[1:]
 		s.stats.v.OverallConnections = s.stats.v.OverallConnections[1:]
+		s.stats.v.RateLimited = s.stats.v.RateLimited[1:]
+		s.stats.v.PlainHTTPOnHTTPS = s.stats.v.PlainHTTPOnHTTPS[1:]
+		s.stats.v.MissingSNI = s.stats.v.MissingSNI[1:]
 		s.stats.v.HealthyHosts = s.stats.v.HealthyHosts[1:]
 		s.stats.v.UnhealthyHosts = s.stats.v.UnhealthyHosts[1:]
 	} else {
-		for i := 0; i <= core.MaxTicks; i++ {
-			s.stats.v.Ticks = append(s.stats.v.Ticks, "")
+		// Pad the series with the ticks before the start
+		for i := 0; i <= s.maxTicks; i++ {
+			tick := now.Add(-time.Duration(s.maxTicks+1-i) * s.cfg.Interval)
+			s.stats.v.Ticks = append(s.stats.v.Ticks, formatTick(tick))
 			s.stats.v.OverallConnections = append(s.stats.v.OverallConnections, 0)
+			s.stats.v.RateLimited = append(s.stats.v.RateLimited, 0)
+			s.stats.v.PlainHTTPOnHTTPS = append(s.stats.v.PlainHTTPOnHTTPS, 0)
+			s.stats.v.MissingSNI = append(s.stats.v.MissingSNI, 0)
 			s.stats.v.HealthyHosts = append(s.stats.v.HealthyHosts, 0)
 			s.stats.v.UnhealthyHosts = append(s.stats.v.UnhealthyHosts, 0)
 		}
 	}
-	s.stats.v.Ticks = append(s.stats.v.Ticks, "")
 
-	s.stats.v.OverallConnections = append(s.stats.v.OverallConnections, s.lastConnections)
-	s.stats.v.HealthyHosts = append(s.stats.v.HealthyHosts, healthyHosts)
-	s.stats.v.UnhealthyHosts = append(s.stats.v.UnhealthyHosts, unhealthyHosts)
+	tick := sample{
+		time:             now,
+		connections:      s.lastConnections,
+		rateLimited:      atomic.SwapUint64(&s.rateLimited, 0),
+		plainHTTPOnHTTPS: atomic.SwapUint64(&s.plainHTTP, 0),
+		missingSNI:       atomic.SwapUint64(&s.missingSNI, 0),
+		healthyHosts:     healthyHosts,
+		unhealthyHosts:   unhealthyHosts,
+	}
+
+	s.stats.v.Ticks = append(s.stats.v.Ticks, formatTick(now))
+	s.stats.v.OverallConnections = append(s.stats.v.OverallConnections, tick.connections)
+	s.stats.v.RateLimited = append(s.stats.v.RateLimited, tick.rateLimited)
+	s.stats.v.PlainHTTPOnHTTPS = append(s.stats.v.PlainHTTPOnHTTPS, tick.plainHTTPOnHTTPS)
+	s.stats.v.MissingSNI = append(s.stats.v.MissingSNI, tick.missingSNI)
+	s.stats.v.HealthyHosts = append(s.stats.v.HealthyHosts, tick.healthyHosts)
+	s.stats.v.UnhealthyHosts = append(s.stats.v.UnhealthyHosts, tick.unhealthyHosts)
+
+	s.addLatest(&tick)
+	for _, r := range s.rollups {
+		r.add(tick)
+	}
+	snapshot := s.historySample(tick)
+
+	// Send a copy to the UI without holding the lock, the receiver may need it to read the stats
+	stats := copyStats(s.stats.v)
+	s.stats.mux.Unlock()
+
+	// The history is written to disk, readers of the stats don't wait for it
+	s.history.Append(snapshot)
+	s.events.Publish(events.Event{Type: events.Stats, Time: snapshot.Time, Stats: &snapshot})
+	s.StatsTick <- stats
+}
+
+// copyStats returns a copy of the stats that shares no slices or maps with the original
+func copyStats(v core.GlobalStats) core.GlobalStats {
+	c := v
+	c.Ticks = append([]string{}, v.Ticks...)
+	c.OverallConnections = append([]uint{}, v.OverallConnections...)
+	c.RateLimited = append([]uint64{}, v.RateLimited...)
+	c.PlainHTTPOnHTTPS = append([]uint64{}, v.PlainHTTPOnHTTPS...)
+	c.MissingSNI = append([]uint64{}, v.MissingSNI...)
+	c.HealthyHosts = append([]int{}, v.HealthyHosts...)
+	c.UnhealthyHosts = append([]int{}, v.UnhealthyHosts...)
+
+	c.Hosts = make(map[string]core.RouterHostWithStats, len(v.Hosts))
+	for name, rh := range v.Hosts {
+		rh.Stats = append([]core.HostStats{}, rh.Stats...)
+		c.Hosts[name] = rh
+	}
+	c.Clusters = copyTraffic(v.Clusters)
+	c.Routes = copyTraffic(v.Routes)
+	c.RouteStats = make(map[string]core.RouteStats, len(v.RouteStats))
+	for hostname, rs := range v.RouteStats {
+		c.RouteStats[hostname] = rs
+	}
+	return c
+}
+
+func copyTraffic(series map[string][]core.TrafficStats) map[string][]core.TrafficStats {
+	c := make(map[string][]core.TrafficStats, len(series))
+	for key, stats := range series {
+		c[key] = append([]core.TrafficStats{}, stats...)
+	}
+	return c
+}
 
-	// Send the stats to the UI
-	s.StatsTick <- s.stats.v
-}
\ No newline at end of file
+// addLatest sets the latest values of the router hosts, clusters and routes in the tick
+func (s *StatsHandler) addLatest(tick *sample) {
+	tick.hosts = make(map[string]hostSample, len(s.stats.v.Hosts))
+	for name, rh := range s.stats.v.Hosts {
+		stats := rh.Stats[len(rh.Stats)-1]
+		rh.Stats = nil
+		rh.Latency = core.LatencyStats{}
+		tick.hosts[name] = hostSample{info: rh, stats: stats}
+	}
+	tick.clusters = lastTraffic(s.stats.v.Clusters)
+	tick.routes = lastTraffic(s.stats.v.Routes)
+}
+
+// historySample returns the values of the router hosts and routes in the tick
+func (s *StatsHandler) historySample(tick sample) core.HistorySample {
+	h := core.HistorySample{
+		Time:        tick.time,
+		Connections: tick.connections,
+		Hosts:       make(map[string]core.HistoryHost, len(tick.hosts)),
+		Routes:      make(map[string]core.HistoryRoute, len(tick.routes)),
+	}
+	for name, rh := range tick.hosts {
+		h.Hosts[name] = core.HistoryHost{ClusterKey: rh.info.ClusterKey, HostIP: rh.info.HostIP, HostStats: rh.stats}
+	}
+	for hostname, t := range tick.routes {
+		h.Routes[hostname] = core.HistoryRoute{TrafficStats: t}
+	}
+	for hostname, rs := range s.stats.v.RouteStats {
+		r := h.Routes[hostname]
+		r.Clusters = rs.Clusters
+		h.Routes[hostname] = r
+	}
+	return h
+}
+
+func lastTraffic(series map[string][]core.TrafficStats) map[string]core.TrafficStats {
+	last := make(map[string]core.TrafficStats, len(series))
+	for key, stats := range series {
+		last[key] = stats[len(stats)-1]
+	}
+	return last
+}
+
+func formatTick(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
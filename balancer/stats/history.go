@@ -0,0 +1,257 @@
+package stats
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/core"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrHistoryDisabled is returned by queries if no history directory is configured
+var ErrHistoryDisabled = errors.New("stats history is disabled")
+
+// segmentTimeFormat names the segment of every day so they sort by their age
+const segmentTimeFormat = "20060102"
+
+const (
+	segmentPrefix = "stats-"
+	segmentSuffix = ".jsonl"
+
+	// maxSampleSize is the longest line of a segment that is read
+	maxSampleSize = 16 * 1024 * 1024
+
+	// MaxHistorySamples are the most samples a query returns. Longer queries get a larger step
+	MaxHistorySamples = 1000
+)
+
+// HistoryQuery selects the samples from From to To. Host keeps only the router host
+// or the route hostname with this name if it is set. Step is the minimum time between
+// two returned samples, it is raised to keep the result within MaxHistorySamples
+type HistoryQuery struct {
+	From time.Time
+	To   time.Time
+	Host string
+	Step time.Duration
+}
+
+// historyResult collects the samples of a query, the first one of every step
+type historyResult struct {
+	step    time.Duration
+	next    time.Time
+	samples []core.HistorySample
+}
+
+func (r *historyResult) wants(t time.Time) bool {
+	return !t.Before(r.next)
+}
+
+func (r *historyResult) add(s core.HistorySample) {
+	r.next = s.Time.Add(r.step)
+	r.samples = append(r.samples, s)
+}
+
+// History appends the samples to a segment file per day in a directory and removes the
+// segments older than the retention. A nil History stores nothing
+type History struct {
+	dir       string
+	retention time.Duration
+
+	file    *os.File
+	segment string
+	mux     sync.Mutex
+}
+
+func OpenHistory(dir string, retention time.Duration) (*History, error) {
+	if len(dir) == 0 {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	h := &History{dir: dir, retention: retention}
+	if err := h.openSegment(time.Now()); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *History) segmentPath(segment string) string {
+	return filepath.Join(h.dir, segmentPrefix+segment+segmentSuffix)
+}
+
+func (h *History) openSegment(t time.Time) error {
+	segment := t.UTC().Format(segmentTimeFormat)
+	file, err := os.OpenFile(h.segmentPath(segment), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	if h.file != nil {
+		h.file.Close()
+	}
+	h.file = file
+	h.segment = segment
+
+	h.removeOldSegments(t)
+	return nil
+}
+
+// removeOldSegments removes the segments of the days that ended before the retention
+func (h *History) removeOldSegments(now time.Time) {
+	if h.retention <= 0 {
+		return
+	}
+
+	segments, err := h.segments()
+	if err != nil {
+		logrus.Warn("Failed to list stats history segments: ", err)
+		return
+	}
+	for _, segment := range segments {
+		day, err := time.Parse(segmentTimeFormat, segment)
+		if err != nil || !day.Add(24*time.Hour).Before(now.Add(-h.retention)) {
+			continue
+		}
+		if err := os.Remove(h.segmentPath(segment)); err != nil {
+			logrus.Warn("Failed to remove old stats history segment: ", err)
+		}
+	}
+}
+
+// segments returns the names of the segments from the oldest to the newest
+func (h *History) segments() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(h.dir, segmentPrefix+"*"+segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]string, 0, len(paths))
+	for _, p := range paths {
+		name := filepath.Base(p)
+		segments = append(segments, strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix))
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// Append writes the sample to the segment of its day
+func (h *History) Append(s core.HistorySample) {
+	if h == nil {
+		return
+	}
+
+	line, err := json.Marshal(s)
+	if err != nil {
+		logrus.Error("Failed to encode stats history sample: ", err)
+		return
+	}
+	line = append(line, '\n')
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	if segment := s.Time.UTC().Format(segmentTimeFormat); segment != h.segment {
+		if err := h.openSegment(s.Time); err != nil {
+			logrus.Error("Failed to open stats history segment: ", err)
+			return
+		}
+	}
+	if _, err := h.file.Write(line); err != nil {
+		logrus.Error("Failed to write stats history: ", err)
+	}
+}
+
+// Query reads the samples of the query from the segments of the days from q.From to q.To
+func (h *History) Query(q HistoryQuery) ([]core.HistorySample, error) {
+	if h == nil {
+		return nil, ErrHistoryDisabled
+	}
+
+	h.mux.Lock()
+	segments, err := h.segments()
+	h.mux.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	from := q.From.UTC().Format(segmentTimeFormat)
+	to := q.To.UTC().Format(segmentTimeFormat)
+
+	result := &historyResult{step: q.Step, samples: []core.HistorySample{}}
+	if step := q.To.Sub(q.From) / MaxHistorySamples; result.step < step {
+		result.step = step
+	}
+	for _, segment := range segments {
+		if segment < from || segment > to {
+			continue
+		}
+		if err := h.readSegment(segment, q, result); err != nil {
+			return nil, err
+		}
+	}
+	return result.samples, nil
+}
+
+// readSegment adds the samples of the query in the segment to the result. Lines that
+// can not be decoded, like the last one after a crash, are skipped
+func (h *History) readSegment(segment string, q HistoryQuery, result *historyResult) error {
+	file, err := os.Open(h.segmentPath(segment))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxSampleSize)
+	for scanner.Scan() {
+		var s core.HistorySample
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			continue
+		}
+		if s.Time.Before(q.From) || s.Time.After(q.To) || !result.wants(s.Time) {
+			continue
+		}
+		if len(q.Host) > 0 {
+			filterHost(&s, q.Host)
+		}
+		result.add(s)
+	}
+	return scanner.Err()
+}
+
+// filterHost keeps only the router host or route with the name host
+func filterHost(s *core.HistorySample, host string) {
+	hosts := map[string]core.HistoryHost{}
+	if rh, ok := s.Hosts[host]; ok {
+		hosts[host] = rh
+	}
+	s.Hosts = hosts
+
+	routes := map[string]core.HistoryRoute{}
+	if r, ok := s.Routes[host]; ok {
+		routes[host] = r
+	}
+	s.Routes = routes
+}
+
+func (h *History) Close() error {
+	if h == nil {
+		return nil
+	}
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return h.file.Close()
+}
@@ -0,0 +1,209 @@
+package stats
+
+import (
+	"time"
+
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/core"
+)
+
+// Resolutions of the stats series. ResolutionLive are the samples of every interval,
+// the others are rollups of the samples over the duration in their name
+const (
+	ResolutionLive     = "live"
+	ResolutionMinute   = "1m"
+	Resolution5Minutes = "5m"
+	ResolutionHour     = "1h"
+)
+
+var rollupResolutions = map[string]time.Duration{
+	ResolutionMinute:   time.Minute,
+	Resolution5Minutes: 5 * time.Minute,
+	ResolutionHour:     time.Hour,
+}
+
+// sample are the values of one tick or the aggregation of the ticks of a rollup interval
+type sample struct {
+	time  time.Time
+	ticks int
+
+	connections      uint
+	rateLimited      uint64
+	plainHTTPOnHTTPS uint64
+	missingSNI       uint64
+	healthyHosts     int
+	unhealthyHosts   int
+
+	hosts    map[string]hostSample
+	clusters map[string]core.TrafficStats
+	routes   map[string]core.TrafficStats
+}
+
+type hostSample struct {
+	// info is the router host without its series
+	info  core.RouterHostWithStats
+	stats core.HostStats
+}
+
+// merge aggregates the tick t into s. Events are summed up, levels keep their peak,
+// healthy counts keep their low, throughput is averaged and byte counters keep the last value
+func (s *sample) merge(t sample) {
+	s.ticks++
+	s.connections = maxUint(s.connections, t.connections)
+	s.rateLimited += t.rateLimited
+	s.plainHTTPOnHTTPS += t.plainHTTPOnHTTPS
+	s.missingSNI += t.missingSNI
+	s.healthyHosts = minInt(s.healthyHosts, t.healthyHosts)
+	s.unhealthyHosts = maxInt(s.unhealthyHosts, t.unhealthyHosts)
+
+	for name, th := range t.hosts {
+		h, ok := s.hosts[name]
+		if !ok {
+			s.hosts[name] = th
+			continue
+		}
+		h.info = th.info
+		h.stats.Healthy = h.stats.Healthy && th.stats.Healthy
+		h.stats.TotalConnections = th.stats.TotalConnections
+		h.stats.ActiveConnections = maxUint(h.stats.ActiveConnections, th.stats.ActiveConnections)
+		h.stats.RefusedConnections += th.stats.RefusedConnections
+		h.stats.RejectedConnections += th.stats.RejectedConnections
+		h.stats.TrafficStats = mergeTraffic(h.stats.TrafficStats, th.stats.TrafficStats, s.ticks)
+		s.hosts[name] = h
+	}
+	for key, tt := range t.clusters {
+		s.clusters[key] = mergeTraffic(s.clusters[key], tt, s.ticks)
+	}
+	for key, tt := range t.routes {
+		s.routes[key] = mergeTraffic(s.routes[key], tt, s.ticks)
+	}
+}
+
+// mergeTraffic adds the tick t as the nth value to the running average of the throughput
+func mergeTraffic(s core.TrafficStats, t core.TrafficStats, n int) core.TrafficStats {
+	s.ThroughputIn += (t.ThroughputIn - s.ThroughputIn) / float64(n)
+	s.ThroughputOut += (t.ThroughputOut - s.ThroughputOut) / float64(n)
+	s.BytesIn = t.BytesIn
+	s.BytesOut = t.BytesOut
+	return s
+}
+
+// rollup aggregates the ticks per resolution and keeps the newest samples in a ring buffer
+type rollup struct {
+	resolution time.Duration
+
+	// current is the sample of the interval that is not yet complete
+	current *sample
+
+	samples []sample
+	next    int
+	full    bool
+}
+
+func newRollup(resolution time.Duration, size int) *rollup {
+	return &rollup{
+		resolution: resolution,
+		samples:    make([]sample, size),
+	}
+}
+
+func (r *rollup) add(t sample) {
+	start := t.time.Truncate(r.resolution)
+	if r.current != nil && !r.current.time.Equal(start) {
+		r.push(*r.current)
+		r.current = nil
+	}
+
+	if r.current == nil {
+		r.current = &sample{
+			time:           start,
+			healthyHosts:   t.healthyHosts,
+			unhealthyHosts: t.unhealthyHosts,
+			hosts:          map[string]hostSample{},
+			clusters:       map[string]core.TrafficStats{},
+			routes:         map[string]core.TrafficStats{},
+		}
+	}
+	r.current.merge(t)
+}
+
+func (r *rollup) push(s sample) {
+	r.samples[r.next] = s
+	r.next = (r.next + 1) % len(r.samples)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// list returns the samples from the oldest to the newest including the incomplete interval
+func (r *rollup) list() []sample {
+	var list []sample
+	if r.full {
+		list = append(list, r.samples[r.next:]...)
+	}
+	list = append(list, r.samples[:r.next]...)
+	if r.current != nil {
+		list = append(list, *r.current)
+	}
+	return list
+}
+
+// series returns the samples in the form of the live stats. Router hosts, clusters and routes
+// that are missing in some samples get empty values there
+func (r *rollup) series() core.GlobalStats {
+	samples := r.list()
+	stats := newGlobalStats()
+
+	for i, s := range samples {
+		stats.Ticks = append(stats.Ticks, formatTick(s.time))
+		stats.OverallConnections = append(stats.OverallConnections, s.connections)
+		stats.RateLimited = append(stats.RateLimited, s.rateLimited)
+		stats.PlainHTTPOnHTTPS = append(stats.PlainHTTPOnHTTPS, s.plainHTTPOnHTTPS)
+		stats.MissingSNI = append(stats.MissingSNI, s.missingSNI)
+		stats.HealthyHosts = append(stats.HealthyHosts, s.healthyHosts)
+		stats.UnhealthyHosts = append(stats.UnhealthyHosts, s.unhealthyHosts)
+
+		for name, h := range s.hosts {
+			rh, ok := stats.Hosts[name]
+			if !ok {
+				rh = h.info
+				rh.Stats = make([]core.HostStats, len(samples))
+			}
+			rh.Stats[i] = h.stats
+			stats.Hosts[name] = rh
+		}
+		setTraffic(stats.Clusters, s.clusters, i, len(samples))
+		setTraffic(stats.Routes, s.routes, i, len(samples))
+	}
+
+	return stats
+}
+
+func setTraffic(series map[string][]core.TrafficStats, traffic map[string]core.TrafficStats, i int, length int) {
+	for key, t := range traffic {
+		if _, ok := series[key]; !ok {
+			series[key] = make([]core.TrafficStats, length)
+		}
+		series[key][i] = t
+	}
+}
+
+func maxUint(a, b uint) uint {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
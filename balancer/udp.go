@@ -0,0 +1,297 @@
+package balancer
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/accesslog"
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/core"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxUDPPacketSize         = 64 * 1024
+	defaultUDPSessionTimeout = 60 * time.Second
+
+	// maxQueuedUDPPackets are the packets of a new session that are kept until its backend is connected
+	maxQueuedUDPPackets = 16
+)
+
+// udpSession forwards the packets of one client to the backend that was elected for it
+type udpSession struct {
+	client  *net.UDPAddr
+	release func()
+	entry   *accesslog.Entry
+
+	// backend and election are set once the session is connected. Until then the
+	// packets of the client are queued, failed sessions drop them
+	backend  *net.UDPConn
+	election *core.Election
+	queued   [][]byte
+	failed   bool
+	mux      sync.Mutex
+
+	// lastActive is the unix time in nanoseconds of the last packet in any direction
+	lastActive int64
+
+	bytesIn  uint64
+	bytesOut uint64
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *udpSession) idle(timeout time.Duration) bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive))) >= timeout
+}
+
+// udpListener balances the udp packets of a service. Every client address gets a session
+// with its own backend, replies of the backend are relayed back to the client.
+type udpListener struct {
+	b       *Balancer
+	service string
+	conn    *net.UDPConn
+	timeout time.Duration
+
+	sessions map[string]*udpSession
+	mux      sync.Mutex
+}
+
+// ListenUDP starts a udp listener for the service
+func (b *Balancer) ListenUDP(service string, addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		logrus.Errorf("Invalid udp listen address %v for service %v: %v", addr, service, err)
+		return err
+	}
+
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		logrus.Errorf("Error starting udp listener for service %v on %v: %v", service, addr, err)
+		return err
+	}
+
+	l := &udpListener{
+		b:        b,
+		service:  service,
+		conn:     conn,
+		timeout:  b.cfg.UDPSessionTimeout,
+		sessions: map[string]*udpSession{},
+	}
+	if l.timeout <= 0 {
+		l.timeout = defaultUDPSessionTimeout
+	}
+
+	go l.serve()
+
+	logrus.Infof("Started udp listener for service %v on %v", service, addr)
+
+	return nil
+}
+
+func (l *udpListener) serve() {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, client, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+
+		session := l.session(client)
+		if session == nil {
+			continue
+		}
+
+		session.touch()
+		l.forward(session, buf[:n])
+	}
+}
+
+// session returns the session of the client and creates it for new clients. New sessions
+// elect and connect their backend in their own goroutine, so the read loop never waits for it.
+// It returns nil if the packets of the client are dropped.
+func (l *udpListener) session(client *net.UDPAddr) *udpSession {
+	key := client.String()
+
+	l.mux.Lock()
+	session, ok := l.sessions[key]
+	l.mux.Unlock()
+	if ok {
+		return session
+	}
+
+	if !l.b.sources.Allowed(client.IP) {
+		logrus.Debugf("Client %v is not allowed to use service %v. Dropping packet", client, l.service)
+		return nil
+	}
+
+	release, err := l.b.limiter.Acquire(client)
+	if err != nil {
+		logrus.Debugf("Dropping udp packet from %v: %v", client, err)
+		l.b.Scheduler.StatsHandler.IncrementRateLimited()
+		return nil
+	}
+
+	session = &udpSession{
+		client:  client,
+		release: release,
+		entry: &accesslog.Entry{
+			Time:     time.Now(),
+			Client:   key,
+			Listener: "udp:" + l.service,
+		},
+	}
+	session.touch()
+
+	l.mux.Lock()
+	l.sessions[key] = session
+	l.mux.Unlock()
+
+	go l.connect(session)
+
+	return session
+}
+
+// forward sends the packet to the backend of the session or queues it until the backend is connected
+func (l *udpListener) forward(session *udpSession, packet []byte) {
+	session.mux.Lock()
+	backend, election := session.backend, session.election
+	if backend == nil {
+		if !session.failed && len(session.queued) < maxQueuedUDPPackets {
+			session.queued = append(session.queued, append([]byte(nil), packet...))
+		}
+		session.mux.Unlock()
+		return
+	}
+	session.mux.Unlock()
+
+	if _, err := backend.Write(packet); err != nil {
+		logrus.Debugf("Error forwarding udp packet of %v to backend %v: %v", session.client, election.RouterHost.Name, err)
+		return
+	}
+	election.AddBytesIn(len(packet))
+	atomic.AddUint64(&session.bytesIn, uint64(len(packet)))
+}
+
+// connect elects the backend of the session, connects to it and sends the queued packets.
+// The session is removed if that fails, the next packet of the client starts a new one
+func (l *udpListener) connect(session *udpSession) {
+	// The client will send again, so the session does not wait in the queue
+	election, err := l.b.Scheduler.ElectRouterHostNoWait(core.Context{Service: l.service})
+	if err != nil {
+		logrus.Error(err, ". Dropping udp packets from: ", session.client)
+		l.failSession(session)
+		return
+	}
+
+	backend := election.RouterHost
+	dialStarted := time.Now()
+	backendConn, err := dialUDP(backend)
+	if err != nil {
+		l.b.Scheduler.UpdateRouterStats(election, IncrementRefused)
+		l.b.Scheduler.UpdateRouterStats(election, DecrementConnection)
+		logrus.Errorf("Error connecting to backend: %v. Err: %v", backend.Name, err)
+		l.failSession(session)
+		return
+	}
+	l.b.Scheduler.UpdateRouterStats(election, IncrementConnection)
+	logrus.Debugf("New udp session of %v to backend %v on port %v", session.client, backend.Name, backend.Port)
+
+	session.entry.SetElection(election)
+	session.entry.SetDialTime(dialStarted)
+
+	// The queue is sent with the lock held, so the next packets of the read loop come after it
+	session.mux.Lock()
+	for _, packet := range session.queued {
+		if _, err := backendConn.Write(packet); err != nil {
+			logrus.Debugf("Error forwarding udp packet of %v to backend %v: %v", session.client, backend.Name, err)
+			continue
+		}
+		election.AddBytesIn(len(packet))
+		atomic.AddUint64(&session.bytesIn, uint64(len(packet)))
+	}
+	session.queued = nil
+	session.backend, session.election = backendConn, election
+	session.mux.Unlock()
+
+	l.relayReplies(session)
+}
+
+// failSession removes a session that could not be connected and drops its queued packets
+func (l *udpListener) failSession(session *udpSession) {
+	session.mux.Lock()
+	session.failed = true
+	session.queued = nil
+	session.mux.Unlock()
+
+	l.mux.Lock()
+	delete(l.sessions, session.client.String())
+	l.mux.Unlock()
+
+	session.release()
+}
+
+// relayReplies sends the packets of the backend back to the client until the session is idle
+func (l *udpListener) relayReplies(session *udpSession) {
+	defer l.closeSession(session)
+
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		session.backend.SetReadDeadline(time.Now().Add(l.timeout))
+		n, err := session.backend.Read(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if session.idle(l.timeout) {
+					session.entry.CloseReason = accesslog.CloseIdle
+					return
+				}
+				continue
+			}
+
+			// Refused packets are reported on the connected socket
+			l.b.Scheduler.UpdateRouterStats(session.election, IncrementRefused)
+			session.entry.CloseReason = accesslog.CloseRouterHost
+			logrus.Debugf("Error reading from backend %v: %v", session.election.RouterHost.Name, err)
+			return
+		}
+
+		session.touch()
+		if _, err := l.conn.WriteToUDP(buf[:n], session.client); err != nil {
+			logrus.Debugf("Error relaying udp packet to %v: %v", session.client, err)
+			continue
+		}
+		session.election.AddBytesOut(n)
+		atomic.AddUint64(&session.bytesOut, uint64(n))
+	}
+}
+
+func (l *udpListener) closeSession(session *udpSession) {
+	l.mux.Lock()
+	delete(l.sessions, session.client.String())
+	l.mux.Unlock()
+
+	session.backend.Close()
+	session.release()
+	l.b.Scheduler.UpdateRouterStats(session.election, DecrementConnection)
+
+	session.election.RouterHost.ObserveLifetime(time.Since(session.entry.Time))
+
+	session.entry.BytesIn = atomic.LoadUint64(&session.bytesIn)
+	session.entry.BytesOut = atomic.LoadUint64(&session.bytesOut)
+	l.b.accessLog.Log(session.entry)
+
+	logrus.Debugf("Closed udp session of %v", session.client)
+}
+
+func dialUDP(backend *core.RouterHost) (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(backend.HostIP, strconv.Itoa(backend.Port)))
+	if err != nil {
+		return nil, err
+	}
+	return net.DialUDP("udp", nil, addr)
+}
@@ -1,22 +1,159 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"os/signal"
 	"syscall"
 
 	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer"
 	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/api"
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/balancing"
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/core"
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/ratelimit"
+	"github.com/ReToCode/openshift-cross-cluster-loadbalancer/balancer/stats"
 	"github.com/sirupsen/logrus"
 )
 
+// networkRates collects repeated -rate-limit-network flags
+type networkRates []ratelimit.NetworkRate
+
+func (n *networkRates) String() string {
+	return ""
+}
+
+func (n *networkRates) Set(v string) error {
+	rate, err := ratelimit.ParseNetworkRate(v)
+	if err != nil {
+		return err
+	}
+	*n = append(*n, rate)
+	return nil
+}
+
+// listenerMap collects repeated -tcp-listener and -udp-listener flags as <service>=<address>
+type listenerMap map[string]string
+
+func (m listenerMap) String() string {
+	return ""
+}
+
+func (m listenerMap) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return fmt.Errorf("invalid listener %v, expected <service>=<address>", v)
+	}
+	m[parts[0]] = parts[1]
+	return nil
+}
+
+// networkList is a repeatable flag of CIDRs or ip addresses that fails on invalid entries
+type networkList []string
+
+func (l *networkList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *networkList) Set(v string) error {
+	if _, err := core.ParseNetwork(v); err != nil {
+		return err
+	}
+	*l = append(*l, v)
+	return nil
+}
+
 func init() {
 	logrus.SetOutput(os.Stdout)
 	logrus.SetLevel(logrus.InfoLevel)
 }
 
 func main() {
+	cfg := balancer.BalancerConfig{TCPListeners: map[string]string{}, UDPListeners: map[string]string{}}
+	flag.StringVar(&cfg.HTTPListen, "http", ":8080", "Listen address for http traffic")
+	flag.StringVar(&cfg.HTTPSListen, "https", ":8443", "Listen address for https traffic")
+	flag.DurationVar(&cfg.RouterHostTimeout, "router-host-timeout", 5*time.Second, "Timeout to connect to a router host")
+	flag.IntVar(&cfg.Scheduler.MaxConnectionsPerRouterHost, "max-connections-per-router-host", 0,
+		"Connection limit for router hosts that don't define their own. 0 means no limit")
+	flag.IntVar(&cfg.Scheduler.QueueSize, "queue-size", 0,
+		"Connections that can wait for a free slot when all router hosts are at their limit. 0 disables the queue")
+	flag.DurationVar(&cfg.Scheduler.QueueTimeout, "queue-timeout", 5*time.Second, "Max time a connection waits in the queue")
+	flag.StringVar(&cfg.Scheduler.Strategy, "balancing-strategy", balancing.StrategyLeastConn,
+		"Selection of the router host within a cluster: leastconn or ewma (least connections weighted by connect latency)")
+	flag.DurationVar(&cfg.Scheduler.Stats.Interval, "stats-interval", stats.DefaultInterval, "Time between two samples of the statistics")
+	flag.DurationVar(&cfg.Scheduler.Stats.Retention, "stats-retention", stats.DefaultRetention,
+		"Time range of the live statistics. Longer ranges are kept in 1m, 5m and 1h rollups")
+	flag.IntVar(&cfg.Scheduler.Stats.RollupSamples, "stats-rollup-samples", stats.DefaultRollupSamples,
+		"Samples kept per rollup resolution")
+	flag.StringVar(&cfg.Scheduler.Stats.HistoryDir, "stats-history-dir", "",
+		"Directory to store the statistics of the router hosts and routes across restarts. Empty disables it")
+	flag.DurationVar(&cfg.Scheduler.Stats.HistoryRetention, "stats-history-retention", 7*24*time.Hour,
+		"Time the stored statistics are kept. 0 keeps all of them")
+	flag.Float64Var(&cfg.RateLimit.GlobalRate, "rate-limit", 0, "New connections per second over all clients. 0 means no limit")
+	flag.IntVar(&cfg.RateLimit.GlobalBurst, "rate-limit-burst", 0, "Burst of new connections over all clients. Defaults to the rate")
+	flag.Float64Var(&cfg.RateLimit.ClientRate, "rate-limit-client", 0, "New connections per second of a single client ip. 0 means no limit")
+	flag.IntVar(&cfg.RateLimit.ClientBurst, "rate-limit-client-burst", 0, "Burst of new connections of a single client ip. Defaults to the rate")
+	flag.Var((*networkRates)(&cfg.RateLimit.NetworkRates), "rate-limit-network",
+		"New connections per second of all clients in a network as <cidr>=<rate>. Can be repeated")
+	flag.IntVar(&cfg.RateLimit.MaxConnectionsPerClient, "max-connections-per-client", 0,
+		"Concurrent connections of a single client ip. 0 means no limit")
+	flag.Var((*networkList)(&cfg.AllowedSources), "allow-source",
+		"Client ip or CIDR that may use the balancer. Can be repeated, if not set everyone is allowed")
+	flag.Var((*networkList)(&cfg.DeniedSources), "deny-source", "Client ip or CIDR that may not use the balancer. Can be repeated")
+	flag.StringVar(&cfg.ProxyProtocol, "proxy-protocol", "none",
+		"PROXY protocol version (none, v1, v2) sent to router hosts of clusters without their own setting")
+	flag.Var((*networkList)(&cfg.AcceptProxyProtocolFrom), "accept-proxy-protocol-from",
+		"Ip or CIDR of a trusted load balancer in front that sends a PROXY protocol header. Can be repeated")
+	flag.StringVar(&cfg.ForwardedHeaders, "forwarded-headers", "none",
+		"Add X-Forwarded-* and Forwarded headers to plain http requests: none, first (request of a connection) or all")
+	flag.BoolVar(&cfg.HTTPRequestBalancing, "http-request-balancing", false,
+		"Elect a router host for every request of plain http connections and pool the router host connections")
+	flag.StringVar(&cfg.CertificateDir, "certificate-dir", "",
+		"Directory with certificates (.pem or .crt and .key) to terminate TLS for routes that ask for it")
+	flag.BoolVar(&cfg.ReencryptInsecureSkipVerify, "reencrypt-insecure-skip-verify", false,
+		"Don't verify the router host certificates when re-encrypting terminated connections")
+	flag.StringVar(&cfg.PlainHTTPOnHTTPS, "plain-http-on-https", balancer.PlainHTTPRedirect,
+		"Plain http clients on the https listener: redirect (to https) or route (by Host header)")
+	flag.StringVar(&cfg.DefaultCluster, "default-cluster", "",
+		"Cluster for TLS connections without SNI hostname. If not set they are closed with a TLS alert")
+	flag.Var(listenerMap(cfg.TCPListeners), "tcp-listener",
+		"Listener for a tcp service of the clusters as <service>=<address>, like mysql=:3306. Can be repeated")
+	flag.Var(listenerMap(cfg.UDPListeners), "udp-listener",
+		"Listener for a udp service of the clusters as <service>=<address>, like dns=:53. Can be repeated")
+	flag.DurationVar(&cfg.UDPSessionTimeout, "udp-session-timeout", 60*time.Second,
+		"Idle time after which the session of a udp client and its backend is closed")
+	flag.StringVar(&cfg.AccessLog.Path, "access-log", "",
+		"File for the access log with one JSON line per connection, - for stdout. Disabled if not set")
+	accessLogMaxSize := flag.Int64("access-log-max-size", 100, "Size in MB at which the access log file is rotated. 0 disables it")
+	flag.DurationVar(&cfg.AccessLog.RotateInterval, "access-log-rotate-interval", 24*time.Hour,
+		"Age at which the access log file is rotated. 0 disables it")
+	flag.IntVar(&cfg.AccessLog.MaxBackups, "access-log-max-backups", 7, "Rotated access log files that are kept. 0 keeps all")
+	apiListen := flag.String("api", ":8089", "Listen address for the api server and UI")
+	apiToken := flag.String("api-token", os.Getenv("SMART_LB_API_TOKEN"),
+		"Bearer token of the certificate endpoints of the api, they are disabled without it. Defaults to $SMART_LB_API_TOKEN")
+	flag.Parse()
+
+	cfg.AccessLog.MaxSize = *accessLogMaxSize * 1024 * 1024
+
+	if !core.ValidProxyProtocol(cfg.ProxyProtocol) {
+		logrus.Fatalf("Invalid PROXY protocol version: %v", cfg.ProxyProtocol)
+	}
+	if !core.ValidForwardedHeadersMode(cfg.ForwardedHeaders) {
+		logrus.Fatalf("Invalid forwarded headers mode: %v", cfg.ForwardedHeaders)
+	}
+	if !balancing.ValidStrategy(cfg.Scheduler.Strategy) {
+		logrus.Fatalf("Invalid balancing strategy: %v", cfg.Scheduler.Strategy)
+	}
+	if cfg.Scheduler.Stats.Interval <= 0 || cfg.Scheduler.Stats.Retention < cfg.Scheduler.Stats.Interval {
+		logrus.Fatalf("Invalid stats interval %v or retention %v", cfg.Scheduler.Stats.Interval, cfg.Scheduler.Stats.Retention)
+	}
+	if !balancer.ValidPlainHTTPMode(cfg.PlainHTTPOnHTTPS) {
+		logrus.Fatalf("Invalid mode for plain http on https: %v", cfg.PlainHTTPOnHTTPS)
+	}
+
 	go func() {
 		c := make(chan os.Signal, 1)
 		signal.Notify(c,
@@ -30,12 +167,13 @@ func main() {
 		logrus.Fatalf("Signal (%v) Detected, Shutting Down", sig)
 	}()
 
-	// Dummy config to develop
-	b := balancer.NewBalancer(":8080", ":8443")
-	b.Start()
+	b := balancer.NewBalancer(cfg)
+	if err := b.Start(); err != nil {
+		logrus.Fatal("Failed to start the balancer: ", err)
+	}
 
 	// Run web server
-	go api.RunAPI(":8089", b)
+	go api.RunAPI(*apiListen, *apiToken, b)
 
 	// Sleep 4 ever
 	select {}
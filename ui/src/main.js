@@ -5,7 +5,7 @@ import VueResource from 'vue-resource';
 
 import store from './store'
 
-Vue.use(VueNativeSock, 'ws://localhost:8089/ws', {store: store, format: 'json'});
+Vue.use(VueNativeSock, 'ws://localhost:8089/ws', {store: store, format: 'json', reconnection: true, reconnectionDelay: 3000});
 Vue.use(VueResource);
 
 // Components
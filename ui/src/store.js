@@ -6,6 +6,8 @@ Vue.use(Vuex);
 export default new Vuex.Store({
   state: {
     stats: {},
+    // live shows the stats from the websocket, 1m, 5m and 1h the rollups from the api
+    resolution: 'live',
     socket: {
       message: '',
       isConnected: false,
@@ -26,8 +28,25 @@ export default new Vuex.Store({
       state.socket.message = message.data
     },
     stats(state, stats) {
+      if (state.resolution === 'live') {
+        state.stats = stats;
+      }
+    },
+    resolution(state, resolution) {
+      state.resolution = resolution;
+    },
+    rollup(state, stats) {
       state.stats = stats;
     }
-  }
+  },
+  getters: {
+    // labels are the ticks in local time, with the date for the rollups
+    labels(state) {
+      const ticks = state.stats.ticks || [];
+      return ticks.map(t => {
+        const d = new Date(t);
+        return state.resolution === 'live' ? d.toLocaleTimeString() : d.toLocaleString();
+      });
+    }
 });
 